@@ -0,0 +1,131 @@
+package gotham
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrAuthFailed is reported by the Server's OnConnError, when the first
+// message of a connection does not authenticate it, see Router.Auth.
+var ErrAuthFailed = errors.New("tcp: authentication failed")
+
+// ErrAuthTimeout is reported by the Server's OnConnError, when a connection
+// is not authenticated within the Server's AuthTimeout.
+var ErrAuthTimeout = errors.New("tcp: authentication timeout")
+
+// authState is the state of an authenticated connection.
+type authState struct {
+	principal interface{}
+}
+
+// authRequirer is implemented by the handlers, which require the connections
+// to be authenticated before routing their messages, such as the Router
+// with the Auth handlers.
+type authRequirer interface {
+	requiresAuth() bool
+}
+
+// Auth sets the handlers of the authentication stage, which run before the
+// normal routing. Once it is set, the messages of a connection are handled
+// by the handlers, along with the global middlewares, instead of their
+// routes, until one of them calls Context.Authenticate. The connection is
+// closed by the Server, if its first message does not authenticate it, or
+// it is not authenticated within the Server's AuthTimeout.
+func (router *Router) Auth(handlers ...HandlerFunc) {
+	router.auth = handlers
+	router.rebuild404Handlers()
+}
+
+func (router *Router) requiresAuth() bool {
+	return len(router.auth) > 0
+}
+
+// Authenticate marks the connection the request was read from as
+// authenticated, and attaches the principal to it, such as the id of
+// the player. The following messages of the connection are routed.
+func (c *Context) Authenticate(principal interface{}) {
+	if c.Request != nil && c.Request.conn != nil {
+		c.Request.conn.authenticate(principal)
+	}
+}
+
+// Authenticated reports whether the connection the request was read from
+// is authenticated, see Router.Auth.
+func (req *Request) Authenticated() bool {
+	return req.conn != nil && req.conn.authenticated()
+}
+
+// Principal returns the principal attached to the connection the request
+// was read from by Context.Authenticate, or nil if it is not authenticated.
+func (req *Request) Principal() interface{} {
+	if req.conn == nil {
+		return nil
+	}
+	return req.conn.principal()
+}
+
+// Authenticated reports whether the connection is authenticated.
+func (hc *Conn) Authenticated() bool {
+	return hc.c.authenticated()
+}
+
+// Principal returns the principal attached to the connection, see Context.Authenticate.
+func (hc *Conn) Principal() interface{} {
+	return hc.c.principal()
+}
+
+func (c *conn) authenticate(principal interface{}) {
+	c.auth.Store(&authState{principal: principal})
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+}
+
+func (c *conn) authenticated() bool {
+	return c.auth.Load() != nil
+}
+
+func (c *conn) principal() interface{} {
+	if state, ok := c.auth.Load().(*authState); ok {
+		return state.principal
+	}
+	return nil
+}
+
+// startAuth reports whether the connection must be authenticated, and
+// starts the timer of the AuthTimeout, if any.
+func (c *conn) startAuth() {
+	ar, ok := c.server.Handler.(authRequirer)
+	c.authRequired = ok && ar.requiresAuth()
+	if !c.authRequired {
+		return
+	}
+	if d := c.server.AuthTimeout; d != 0 {
+		c.authTimer = time.AfterFunc(d, c.authExpired)
+	}
+}
+
+// authExpired closes the connection, which is not authenticated in time.
+func (c *conn) authExpired() {
+	if c.authenticated() {
+		return
+	}
+	c.connError("auth", ErrAuthTimeout)
+	c.rwc.Close()
+}
+
+// needsAuth reports whether the next message of the connection
+// is handled by the authentication stage.
+func (c *conn) needsAuth() bool {
+	return c.authRequired && !c.authenticated()
+}
+
+// authFailed reports the connection not authenticated by its first
+// message, which is closed then.
+func (c *conn) authFailed() bool {
+	if !c.needsAuth() {
+		return false
+	}
+	c.connError("auth", ErrAuthFailed)
+	return true
+}
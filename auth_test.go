@@ -0,0 +1,127 @@
+package gotham
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterAuthChains(t *testing.T) {
+	router := New()
+	router.Use(func(c *Context) {})
+	router.NoRoute(func(c *Context) {})
+	assert.Nil(t, router.allAuth)
+	assert.False(t, router.requiresAuth())
+
+	router.Auth(func(c *Context) {})
+	assert.True(t, router.requiresAuth())
+	assert.Equal(t, 2, len(router.allAuth))
+	assert.Equal(t, 2, len(router.allNoRoute))
+
+	// the chains are rebuilt with the global middlewares
+	router.Use(func(c *Context) {})
+	assert.Equal(t, 3, len(router.allAuth))
+	assert.Equal(t, 3, len(router.allNoRoute))
+	assert.NotEqual(t, nameOfFunction(router.allAuth.Last()), nameOfFunction(router.allNoRoute.Last()))
+}
+
+func authRouter() *Router {
+	router := New()
+	router.Auth(func(c *Context) {
+		var msg pb.Ping
+		proto.Unmarshal(c.Request.Data.([]byte), &msg)
+		if c.Request.TypeURL == "pb.Ping" && msg.Message == "secret" {
+			c.Authenticate("bruce")
+			c.Write(&pb.Ping{Message: "welcome"})
+			return
+		}
+		c.Write(&pb.Ping{Message: "denied"})
+	})
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: c.Request.Principal().(string)})
+	})
+	return router
+}
+
+func TestServerAuth(t *testing.T) {
+	addr := "127.0.0.1:9016"
+	for _, n := range []int{0, 4} {
+		connErrors := make(chan *ConnError, 1)
+		server := &Server{Addr: addr, Handler: authRouter(), Codec: &ProtobufCodec{}}
+		server.MaxConcurrentRequests = n
+		server.AuthTimeout = time.Millisecond * 100
+		server.SendGoAwayOnError = true
+		server.OnConnError = func(_ net.Conn, err *ConnError) { connErrors <- err }
+		go server.ListenAndServe()
+
+		time.Sleep(time.Millisecond * 5)
+
+		dial := func() *Client {
+			client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return client
+		}
+		call := func(client *Client, message string) (string, error) {
+			var res Request
+			if err := client.Call(context.Background(), &pb.Ping{Message: message}, &res); err != nil {
+				return "", err
+			}
+			var msg pb.Ping
+			assert.NoError(t, proto.Unmarshal(res.Data.([]byte), &msg))
+			return msg.Message, nil
+		}
+
+		// the messages are routed, once the connection is authenticated
+		client := dial()
+		res, err := call(client, "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "welcome", res)
+		res, err = call(client, "hello")
+		assert.NoError(t, err)
+		assert.Equal(t, "bruce", res)
+		client.Close()
+
+		// the message following the auth one is routed as well
+		client = dial()
+		assert.NoError(t, client.Send(context.Background(), &pb.Ping{Message: "secret"}))
+		res, err = call(client, "hello")
+		assert.NoError(t, err)
+		assert.Equal(t, "bruce", res)
+		client.Close()
+
+		// the connection is closed, if the first message does not authenticate it
+		client = dial()
+		res, err = call(client, "hello")
+		assert.NoError(t, err)
+		assert.Equal(t, "denied", res)
+		ce := <-connErrors
+		assert.Equal(t, "auth", ce.Op)
+		assert.Equal(t, ErrAuthFailed, ce.Err)
+		_, err = client.Recv(context.Background())
+		var ga *GoAwayError
+		assert.True(t, errors.As(err, &ga))
+		assert.Equal(t, ErrCodeAuth, ga.Code)
+		client.Close()
+
+		// or if it is not authenticated in time
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangePreface(t, conn)
+		assert.Equal(t, ErrCodeAuth, readGoAway(t, bufio.NewReader(conn)))
+		assert.Equal(t, ErrAuthTimeout, (<-connErrors).Err)
+		conn.Close()
+
+		server.Close()
+	}
+}
@@ -1,6 +1,12 @@
 package gotham
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
@@ -93,3 +99,237 @@ func runRequest(B *testing.B, r *Router, path string) {
 		r.ServeProto(w, req)
 	}
 }
+
+// dataFrame returns the frame of a ping message.
+func dataFrame(B *testing.B, codec Codec) []byte {
+	data, err := codec.Marshal(&pb.Ping{Message: "Ping"})
+	if err != nil {
+		B.Fatal(err)
+	}
+	var buf bytes.Buffer
+	defaultFramer.writeData(&buf, 1, data)
+	return buf.Bytes()
+}
+
+func pongRouter() *Router {
+	SetMode("release")
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+	return router
+}
+
+// BenchmarkReadFrameBody reads the requests without the pools.
+func BenchmarkReadFrameBody(B *testing.B) {
+	codec := &ProtobufCodec{}
+	raw := dataFrame(B, codec)
+	r := bytes.NewReader(raw)
+
+	B.ReportAllocs()
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		r.Reset(raw)
+		fh, _ := ReadFrameHeader(r)
+		if _, err := ReadFrameBody(r, fh, codec); err != nil {
+			B.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadRequest reads the requests from the pools, as the Server does.
+func BenchmarkReadRequest(B *testing.B) {
+	raw := dataFrame(B, &ProtobufCodec{})
+	r := bytes.NewReader(raw)
+	c := (&Server{Codec: &ProtobufCodec{}}).newConn(nil)
+	c.bufr = bufio.NewReader(r)
+
+	B.ReportAllocs()
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		r.Reset(raw)
+		c.bufr.Reset(r)
+		fh, _ := ReadFrameHeader(c.bufr)
+		req, err := c.readRequest(fh)
+		if err != nil {
+			B.Fatal(err)
+		}
+		putRequest(req)
+	}
+}
+
+// BenchmarkServeFrame reads, handles and responds the requests without the pools.
+func BenchmarkServeFrame(B *testing.B) {
+	codec := &ProtobufCodec{}
+	router := pongRouter()
+	raw := dataFrame(B, codec)
+	r := bytes.NewReader(raw)
+	bufw := bufio.NewWriter(io.Discard)
+
+	B.ReportAllocs()
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		r.Reset(raw)
+		fh, _ := ReadFrameHeader(r)
+		req, err := ReadFrameBody(r, fh, codec)
+		if err != nil {
+			B.Fatal(err)
+		}
+		w := NewResponseWriter(bufw, codec)
+		w.streamID = req.StreamID
+		router.ServeProto(w, req)
+		w.Flush()
+	}
+}
+
+// BenchmarkServeRequest reads, handles and responds the requests
+// from the pools, as the Server does.
+func BenchmarkServeRequest(B *testing.B) {
+	raw := dataFrame(B, &ProtobufCodec{})
+	r := bytes.NewReader(raw)
+	c := (&Server{Codec: &ProtobufCodec{}, Handler: pongRouter()}).newConn(nil)
+	c.bufr = bufio.NewReader(r)
+	c.bufw = bufio.NewWriter(io.Discard)
+
+	B.ReportAllocs()
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		r.Reset(raw)
+		c.bufr.Reset(r)
+		fh, _ := ReadFrameHeader(c.bufr)
+		req, err := c.readRequest(fh)
+		if err != nil {
+			B.Fatal(err)
+		}
+		req.conn = c
+		c.serveRequest(req)
+		putRequest(req)
+	}
+}
+
+// BenchmarkServeRequestLarge handles the requests as the Server does,
+// whose large responses are framed into the writer of the connection.
+func BenchmarkServeRequestLarge(B *testing.B) {
+	SetMode("release")
+	payload := make([]byte, 64<<10)
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Error{Message: string(payload)})
+	})
+	raw := dataFrame(B, &ProtobufCodec{})
+	r := bytes.NewReader(raw)
+	c := (&Server{Codec: &ProtobufCodec{}, Handler: router}).newConn(nil)
+	c.bufr = bufio.NewReader(r)
+	c.bufw = bufio.NewWriter(io.Discard)
+
+	B.ReportAllocs()
+	B.SetBytes(int64(len(payload)))
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		r.Reset(raw)
+		c.bufr.Reset(r)
+		fh, _ := ReadFrameHeader(c.bufr)
+		req, err := c.readRequest(fh)
+		if err != nil {
+			B.Fatal(err)
+		}
+		req.conn = c
+		c.serveRequest(req)
+		putRequest(req)
+	}
+}
+
+// appendFrame writes the frame, as writeFrame did before net.Buffers,
+// by appending the payload to the header.
+func appendFrame(w io.Writer, fh FrameHeader, data []byte) error {
+	length := len(data)
+	header := [frameHeaderLen + streamIDLen]byte{
+		byte(length >> 16),
+		byte(length >> 8),
+		byte(length),
+		byte(fh.Type),
+		byte(fh.Flags | FlagFrameAck | FlagFrameStream),
+	}
+	binary.BigEndian.PutUint32(header[frameHeaderLen:], fh.StreamID)
+	wbuf := append(header[:], data...)
+	n, err := w.Write(wbuf)
+	if err == nil && n != len(wbuf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// BenchmarkWriteFrame writes the responses to a TCP connection through
+// the bufio.Writer, as the Server does, by net.Buffers and by appending
+// the payload to the header.
+func BenchmarkWriteFrame(B *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		B.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		B.Fatal(err)
+	}
+	defer conn.Close()
+	bufw := bufio.NewWriter(conn)
+
+	for _, size := range []int{128, 64 << 10} {
+		payload := make([]byte, size)
+		for _, bc := range []struct {
+			name  string
+			write func(io.Writer, FrameHeader, []byte) error
+		}{{"buffers", writeFrame}, {"append", appendFrame}} {
+			B.Run(fmt.Sprintf("%s/%d", bc.name, size), func(B *testing.B) {
+				B.ReportAllocs()
+				B.SetBytes(int64(size))
+				for i := 0; i < B.N; i++ {
+					if err := bc.write(bufw, FrameHeader{Type: FrameData, StreamID: 1}, payload); err != nil {
+						B.Fatal(err)
+					}
+				}
+				if err := bufw.Flush(); err != nil {
+					B.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCompress writes and reads the compressed messages,
+// with the writers and the readers recycled by the compressor.
+func BenchmarkCompress(B *testing.B) {
+	fr := &Framer{Compressor: &GzipCompressor{}}
+	msg := bytes.Repeat([]byte("gotham"), 1000)
+	var buf bytes.Buffer
+
+	B.ReportAllocs()
+	B.SetBytes(int64(len(msg)))
+	B.ResetTimer()
+
+	for i := 0; i < B.N; i++ {
+		buf.Reset()
+		if err := fr.writeData(&buf, 1, msg); err != nil {
+			B.Fatal(err)
+		}
+		fh, _ := ReadFrameHeader(&buf)
+		payload, err := fr.readMessage(&buf, fh)
+		if err != nil {
+			B.Fatal(err)
+		}
+		putBuffer(payload)
+	}
+}
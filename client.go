@@ -0,0 +1,667 @@
+package gotham
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClientClosed is returned by the Client's methods after Close was called,
+var ErrClientClosed = errors.New("tcp: client closed")
+
+// Dialer contains options for connecting to a server.
+type Dialer struct {
+	// Codec encodes the outgoing and decodes the incoming messages.
+	Codec Codec
+
+	// Timeout is the maximum amount of time a dial will wait for
+	// a connect to complete.
+	Timeout time.Duration
+
+	// WriteTimeout is the maximum duration before timing out
+	// writes of a message, when the context has no deadline.
+	WriteTimeout time.Duration
+
+	// KeepAlive is the interval of the pings sent to keep the connection
+	// alive. It is negotiated with the server when connecting, the server
+	// may ask for a shorter one, even if it is zero.
+	KeepAlive time.Duration
+
+	// MaxReadFrameSize is the maximum payload size of the frames read
+	// from the server, it is announced to the server by SettingMaxFrameSize.
+	// The larger frames are discarded, without closing the connection.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxReadFrameSize uint32
+
+	// MaxWriteFrameSize is the maximum payload size of the frames written,
+	// it is lowered to the size announced by the server, if any.
+	// The larger messages are split into the continuation frames.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxWriteFrameSize uint32
+
+	// MaxMessageSize is the maximum size of a message read, which is split
+	// into the continuation frames. It is announced to the server by
+	// SettingMaxMessageSize, the larger messages are discarded, without
+	// closing the connection. If zero, DefaultMaxMessageSize is used.
+	// Writing a message larger than the server announced fails with
+	// ErrMessageTooLarge, and leaves the connection untouched.
+	MaxMessageSize uint32
+
+	// Compressor compresses the messages, which are not smaller than
+	// CompressThreshold. It is announced to the server by SettingCompressor,
+	// and used only if the server announces the same one.
+	// If nil, the messages are never compressed.
+	Compressor Compressor
+
+	// CompressThreshold is the size of the smallest message compressed.
+	// If zero, DefaultCompressThreshold is used.
+	CompressThreshold int
+
+	// Checksum adds a checksum to the frames written, so the corrupted
+	// payloads are detected by the server. It is used only if the server
+	// announces SettingChecksum. The checksums of the frames read are
+	// always verified, if they have one.
+	Checksum bool
+
+	// OnChecksumError specifies an optional callback function that is
+	// called when the checksum of a frame read from the server does not
+	// match. The frame, or the message it belongs to, is discarded.
+	OnChecksumError func(FrameHeader)
+
+	// SecureConfig optionally secures the connection, see SecureConfig.
+	// The server must use the same config.
+	SecureConfig *SecureConfig
+
+	// TLSConfig optionally secures the connection by TLS, it is used
+	// by DialContext only. If its ServerName is empty, the host of the
+	// address is used. The client certificates, if any, are presented
+	// to the server asking for them.
+	TLSConfig *tls.Config
+
+	// TraceWriter is the writer of the frames traced, see Client.SetTrace.
+	// If nil, DefaultWriter is used.
+	TraceWriter io.Writer
+
+	// MaxRecvQueue is the maximum number of the messages queued for Recv,
+	// the messages read while the queue is full are dropped.
+	// If zero, DefaultMaxRecvQueue is used.
+	MaxRecvQueue int
+
+	// OnRecvDrop specifies an optional callback function that is called,
+	// when a message is dropped instead of queued for Recv, since the queue
+	// is full, or its stream was never issued by a call. It is called by
+	// the goroutine reading the connection, so it must not block.
+	// The drops are counted by Client.RecvDrops anyway.
+	OnRecvDrop func(*Client, *Request)
+
+	// OnGoAway specifies an optional callback function that is called,
+	// when the server sent the GOAWAY frame, such as while it is shutting
+	// down. The new calls fail with the GoAwayError after it, so the
+	// callback may dial another server. It is called by the goroutine
+	// reading the connection, so it must not block.
+	OnGoAway func(*Client, *GoAwayError)
+}
+
+// DefaultMaxRecvQueue is the number of the messages queued for Recv,
+// if the Dialer's MaxRecvQueue is zero.
+const DefaultMaxRecvQueue = 256
+
+// Dial connects to the address on the named network, using the given codec.
+func Dial(network, addr string, codec Codec) (*Client, error) {
+	d := &Dialer{Codec: codec}
+	return d.Dial(network, addr)
+}
+
+// Dial connects to the address on the named network.
+func (d *Dialer) Dial(network, addr string) (*Client, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address on the named network using
+// the provided context.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (*Client, error) {
+	nd := &net.Dialer{Timeout: d.Timeout}
+	rwc, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.TLSConfig != nil {
+		config := d.TLSConfig
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config = config.Clone()
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(rwc, config)
+		// report the handshake errors by the dial
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		rwc = tlsConn
+	}
+
+	if d.SecureConfig != nil {
+		sc := SecureClient(rwc, d.SecureConfig)
+		// report the handshake errors by the dial
+		if deadline, ok := ctx.Deadline(); ok {
+			rwc.SetDeadline(deadline)
+		}
+		err = sc.Handshake()
+		rwc.SetDeadline(time.Time{})
+		if err != nil {
+			rwc.Close()
+			return nil, err
+		}
+		rwc = sc
+	}
+	return d.NewClient(rwc), nil
+}
+
+// maxRecvQueue returns the number of the messages queued for Recv.
+func (d *Dialer) maxRecvQueue() int {
+	if d.MaxRecvQueue > 0 {
+		return d.MaxRecvQueue
+	}
+	return DefaultMaxRecvQueue
+}
+
+// framer returns a Framer with the frame size limits of the dialer.
+func (d *Dialer) framer() *Framer {
+	return &Framer{
+		MaxReadFrameSize:   d.MaxReadFrameSize,
+		MaxWriteFrameSize:  d.MaxWriteFrameSize,
+		MaxReadMessageSize: d.MaxMessageSize,
+		CompressThreshold:  d.CompressThreshold,
+		Checksum:           d.Checksum,
+	}
+}
+
+// NewClient returns a Client using the given connection,
+// which is useful for transports without a net.Dialer, such as kcp.
+// The connection is secured by the SecureConfig, if any, the handshake
+// errors are reported by the Client's methods.
+func (d *Dialer) NewClient(rwc net.Conn) *Client {
+	if d.Codec == nil {
+		panic("gotham: nil codec")
+	}
+	if _, ok := rwc.(*SecureConn); !ok && d.SecureConfig != nil {
+		rwc = SecureClient(rwc, d.SecureConfig)
+	}
+	c := &Client{
+		dialer:  d,
+		rwc:     rwc,
+		bufw:    newBufioWriter(rwc),
+		pending: make(map[uint32]chan callResult),
+		pings:   make(map[uint64]chan struct{}),
+		recvc:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	c.tracer = c.newTracer()
+	fr := d.framer()
+	// no checksums, until the server announces the support of them
+	nfr := fr.negotiate(connSettings{}, nil)
+	nfr.tracer = c.tracer
+	c.framer.Store(nfr)
+	go c.readLoop(newBufioReader(rwc))
+
+	// the preface is sent before any frame, the server's
+	// one is read by the readLoop before its frames
+	c.wmu.Lock()
+	WritePreface(c.bufw, ProtocolVersion)
+	c.wmu.Unlock()
+
+	// announce the client's settings, the server's ones arrive
+	// asynchronously with the acknowledgement
+	c.writeSettings(context.Background(), []Setting{
+		{ID: SettingMaxFrameSize, Val: fr.maxReadFrameSize()},
+		{ID: SettingCodec, Val: codecID(d.Codec)},
+		{ID: SettingKeepAlive, Val: uint32(d.KeepAlive / time.Millisecond)},
+		{ID: SettingMaxMessageSize, Val: fr.maxReadMessageSize()},
+		{ID: SettingCompressor, Val: compressorID(d.Compressor)},
+		{ID: SettingChecksum, Val: 1},
+	})
+	return c
+}
+
+// Client is a connection to a server. It owns the framing of the messages,
+// so the callers only deal with the messages themselves.
+// A Client is safe for concurrent use by multiple goroutines, the calls
+// are multiplexed over the connection, each of them is tagged with its
+// own stream id, and the responses are matched to the calls by it.
+type Client struct {
+	dialer *Dialer
+
+	// rwc is the underlying network connection.
+	rwc net.Conn
+
+	// framer is the *Framer limiting the size of the frames,
+	// it is replaced when the server announces its settings.
+	framer atomic.Value
+
+	// wmu guards bufw, so the frames are never interleaved.
+	wmu  sync.Mutex
+	bufw *bufio.Writer
+
+	// mu guards the fields below.
+	mu sync.Mutex
+	// nextStreamID is the stream id of the next call.
+	nextStreamID uint32
+	// pending are the calls waiting for the responses, by stream id.
+	pending map[uint32]chan callResult
+	// abandoned are the stream ids of the calls interrupted by their
+	// contexts, in the order they were abandoned, see abandonCall.
+	abandoned    map[uint32]struct{}
+	abandonedIDs []uint32
+	// nextPingID is the payload of the next ping.
+	nextPingID uint64
+	// pings are the pings waiting for the acknowledgements, by payload.
+	pings map[uint64]chan struct{}
+	// settings are announced by the server.
+	settings connSettings
+	// settingsAck are the UpdateSettings waiting for the acknowledgements.
+	settingsAck []chan struct{}
+	// queue are the received messages, which are not the responses of calls.
+	queue []*Request
+	// err is set to the first connection error, the client is unusable after it.
+	err error
+
+	// recvc is signaled, when a message is queued.
+	recvc chan struct{}
+	// done is closed, when the connection is broken or closed.
+	done chan struct{}
+
+	// version is the protocol version answered by the server,
+	// zero until it is read. Accessed atomically.
+	version uint32
+
+	// recvDrops counts the messages dropped instead of queued for Recv,
+	// see RecvDrops. Accessed atomically.
+	recvDrops uint64
+
+	// trace are the trace flags, see SetTrace. Accessed atomically.
+	trace uint32
+	// tracer logs the frames of the client.
+	tracer *frameTracer
+
+	// keepAlive is the interval of the keepalive pings. Accessed atomically.
+	keepAlive int64
+	// keepAliveStarted is non-zero, if the keepalive pings are started.
+	keepAliveStarted int32
+}
+
+// callResult is the response of a call, or the error reading it.
+type callResult struct {
+	res *Request
+	err error
+}
+
+// Send writes the message to the server without waiting for a response.
+func (c *Client) Send(ctx context.Context, msg interface{}) error {
+	if err := c.getErr(); err != nil {
+		return err
+	}
+	return c.write(ctx, 0, msg)
+}
+
+// Call writes the request to the server, then waits for the response of it,
+// and reads it into resp. Any other messages written by the server in response
+// to the request can be read by Recv.
+func (c *Client) Call(ctx context.Context, req interface{}, resp *Request) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextStreamID++
+	if c.nextStreamID == 0 {
+		// zero means no stream
+		c.nextStreamID++
+	}
+	id := c.nextStreamID
+	ch := make(chan callResult, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	if err := c.write(ctx, id, req); err != nil {
+		c.removeCall(id)
+		return err
+	}
+
+	select {
+	case r := <-ch:
+		return r.read(resp)
+	case <-ctx.Done():
+		c.abandonCall(id)
+		return ctx.Err()
+	case <-c.done:
+		select {
+		case r := <-ch:
+			return r.read(resp)
+		default:
+		}
+		return c.getErr()
+	}
+}
+
+func (r callResult) read(resp *Request) error {
+	if r.err != nil {
+		return r.err
+	}
+	*resp = *r.res
+	return nil
+}
+
+// Recv waits for the next message written by the server, which is not
+// a response read by Call, such as the responses of Send.
+// The messages are queued until they are received, up to the
+// Dialer's MaxRecvQueue.
+func (c *Client) Recv(ctx context.Context) (*Request, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			res := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return res, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-c.recvc:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+		}
+	}
+}
+
+// Close closes the connection.
+// Any blocked Call, Send or Recv will be unblocked and return errors.
+func (c *Client) Close() error {
+	c.setErr(ErrClientClosed)
+	err := c.rwc.Close()
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw != nil {
+		putBufioWriter(c.bufw)
+		c.bufw = nil
+	}
+	return err
+}
+
+// ProtoVersion returns the protocol version negotiated with the server,
+// or zero if the server has not answered the preface yet.
+func (c *Client) ProtoVersion() uint8 {
+	return uint8(atomic.LoadUint32(&c.version))
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+func (c *Client) write(ctx context.Context, streamID uint32, msg interface{}) error {
+	// marshal errors leave the connection untouched
+	buf, err := c.dialer.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(ctx, FrameHeader{Type: FrameData, StreamID: streamID}, buf)
+}
+
+func (c *Client) writeFrame(ctx context.Context, fh FrameHeader, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeFrameLocked(ctx, fh, payload)
+}
+
+func (c *Client) writeFrameLocked(ctx context.Context, fh FrameHeader, payload []byte) (err error) {
+	if c.bufw == nil {
+		return c.getErr()
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok && c.dialer.WriteTimeout != 0 {
+		deadline = time.Now().Add(c.dialer.WriteTimeout)
+	}
+	c.rwc.SetWriteDeadline(deadline)
+
+	err = c.getFramer().writeFrame(c.bufw, fh, payload)
+	// oversize frames are never written, so the connection is still usable
+	if errors.Is(err, ErrFrameTooLarge) || err == ErrMessageTooLarge {
+		return err
+	}
+	if err == nil {
+		err = c.bufw.Flush()
+	}
+	if err != nil {
+		// the framing can not be recovered after a partial write
+		c.setErr(err)
+		c.rwc.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the conn may be closed by the read loop already,
+		// for the error it recorded first
+		return c.getErr()
+	}
+	return nil
+}
+
+// readLoop reads the messages from the server, and dispatches them
+// to the pending calls, or the receiving queue.
+func (c *Client) readLoop(bufr *bufio.Reader) {
+	defer func() {
+		putBufioReader(bufr)
+		close(c.done)
+	}()
+
+	if err := c.readPreface(bufr); err != nil {
+		c.setErr(err)
+		c.rwc.Close()
+		return
+	}
+
+	for {
+		fh, err := c.getFramer().ReadFrameHeader(bufr)
+		if errors.Is(err, ErrFrameTooLarge) {
+			// skip the oversize frame, and fail the call waiting for it
+			if err := skipFramePayload(bufr, fh); err != nil {
+				c.setErr(err)
+				c.rwc.Close()
+				return
+			}
+			if fh.Type == FrameData {
+				c.failCall(fh.StreamID, err)
+			}
+			continue
+		}
+		if err != nil {
+			c.setErr(err)
+			c.rwc.Close()
+			return
+		}
+
+		if fh.Type != FrameData {
+			// the control frames are processed synchronously,
+			// so the payload is returned to the pool after it
+			buf := getBuffer(int(fh.Length))
+			err := readPayload(bufr, fh, *buf)
+			if err == nil {
+				c.tracer.trace(TraceReads, fh, *buf)
+				err = c.processFrame(fh, *buf)
+			}
+			putBuffer(buf)
+			if err == ErrChecksum {
+				c.checksumError(fh)
+				continue
+			}
+			if err != nil {
+				c.setErr(err)
+				c.rwc.Close()
+				return
+			}
+			continue
+		}
+
+		// reassemble the message continued by the CONTINUATION frames,
+		// its buffer is never returned to the pool, since the responses
+		// are retained by the callers
+		buf, err := c.getFramer().readMessage(bufr, fh)
+		if isMessageError(err) {
+			if err == ErrChecksum {
+				c.checksumError(fh)
+			}
+			c.failCall(fh.StreamID, err)
+			continue
+		}
+		if err != nil {
+			c.setErr(err)
+			c.rwc.Close()
+			return
+		}
+
+		res := &Request{StreamID: fh.StreamID}
+		if err := c.dialer.Codec.Unmarshal(*buf, res); err != nil {
+			// skip the message, unmarshal errors leave the connection untouched
+			continue
+		}
+
+		var dropped *Request
+		c.mu.Lock()
+		if ch, ok := c.pending[res.StreamID]; ok && res.StreamID != 0 {
+			delete(c.pending, res.StreamID)
+			ch <- callResult{res: res}
+		} else if _, ok := c.abandoned[res.StreamID]; ok {
+			// the late responses of the abandoned calls are dropped
+		} else if res.StreamID <= c.nextStreamID && len(c.queue) < c.dialer.maxRecvQueue() {
+			c.queue = append(c.queue, res)
+			select {
+			case c.recvc <- struct{}{}:
+			default:
+			}
+		} else {
+			// the messages of the streams never issued are dropped,
+			// and the ones not received in time
+			dropped = res
+		}
+		c.mu.Unlock()
+
+		if dropped != nil {
+			atomic.AddUint64(&c.recvDrops, 1)
+			if hook := c.dialer.OnRecvDrop; hook != nil {
+				hook(c, dropped)
+			}
+		}
+	}
+}
+
+// processFrame handles the control frame.
+func (c *Client) processFrame(fh FrameHeader, payload []byte) error {
+	switch fh.Type {
+	case FramePing:
+		return c.processPing(fh, payload)
+	case FrameSettings:
+		return c.processSettings(fh, payload)
+	case FrameGoAway:
+		return c.processGoAway(payload)
+	case FrameRSTStream:
+		return c.processResetStream(fh, payload)
+	}
+	// ignore the unknown frames
+	return nil
+}
+
+func (c *Client) getFramer() *Framer {
+	return c.framer.Load().(*Framer)
+}
+
+func (c *Client) checksumError(fh FrameHeader) {
+	if hook := c.dialer.OnChecksumError; hook != nil {
+		hook(fh)
+	}
+}
+
+// failCall fails the call waiting for the response of the stream,
+// which can not be read.
+func (c *Client) failCall(id uint32, err error) {
+	if id == 0 {
+		return
+	}
+	c.mu.Lock()
+	if ch, ok := c.pending[id]; ok {
+		delete(c.pending, id)
+		ch <- callResult{err: err}
+	}
+	c.mu.Unlock()
+}
+
+// RecvDrops returns the number of the messages dropped instead of queued
+// for Recv, see Dialer.OnRecvDrop.
+func (c *Client) RecvDrops() uint64 {
+	return atomic.LoadUint64(&c.recvDrops)
+}
+
+func (c *Client) removeCall(id uint32) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// maxAbandoned is the number of the abandoned calls remembered,
+// the oldest ones are forgotten beyond it.
+const maxAbandoned = 1024
+
+// abandonCall removes the call interrupted by its context, and remembers
+// its stream id, so the late responses are dropped, instead of received
+// by Recv as the messages written by the server.
+func (c *Client) abandonCall(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	if c.abandoned == nil {
+		c.abandoned = make(map[uint32]struct{})
+	}
+	if _, ok := c.abandoned[id]; ok {
+		return
+	}
+	c.abandoned[id] = struct{}{}
+	c.abandonedIDs = append(c.abandonedIDs, id)
+	if len(c.abandonedIDs) > maxAbandoned {
+		delete(c.abandoned, c.abandonedIDs[0])
+		c.abandonedIDs = c.abandonedIDs[1:]
+	}
+}
+
+func (c *Client) getErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// setErr records the first connection error.
+func (c *Client) setErr(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,224 @@
+package gotham
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTestRouter serves the test router on a free port,
+// and returns the address of it.
+func serveTestRouter(t *testing.T) (*Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		var ping pb.Ping
+		proto.Unmarshal(c.Request.Data.([]byte), &ping)
+		c.Write(&pb.Ping{Message: "Pong" + strings.TrimPrefix(ping.GetMessage(), "Ping")})
+	})
+	router.Handle("pb.Error", func(c *Context) {
+		time.Sleep(time.Millisecond * 50)
+		c.Write(&pb.Error{Code: 400, Message: "Pong Error"})
+	})
+
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.Serve(ln)
+	return server, addr
+}
+
+func TestClientCall(t *testing.T) {
+	server, addr := serveTestRouter(t)
+	defer server.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	assert.Equal(t, addr, client.RemoteAddr().String())
+
+	for i := 0; i < 3; i++ {
+		var res Request
+		err = client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+		assert.NoError(t, err)
+		assert.Equal(t, "pb.Ping", res.TypeURL)
+
+		var pong pb.Ping
+		proto.Unmarshal(res.Data.([]byte), &pong)
+		assert.Equal(t, "Pong", pong.GetMessage())
+	}
+
+	// marshal errors do not break the connection
+	var res Request
+	err = client.Call(context.Background(), "not a message", &res)
+	assert.Error(t, err)
+	err = client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+	assert.NoError(t, err)
+}
+
+func TestClientSendRecv(t *testing.T) {
+	server, addr := serveTestRouter(t)
+	defer server.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	assert.NoError(t, client.Send(context.Background(), &pb.Ping{Message: "Ping"}))
+	assert.NoError(t, client.Send(context.Background(), &pb.Ping{Message: "Ping"}))
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Recv(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "pb.Ping", res.TypeURL)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	server, addr := serveTestRouter(t)
+	defer server.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server takes 50ms to answer pb.Error
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	var res Request
+	err = client.Call(ctx, &pb.Error{Code: 400}, &res)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the connection is still usable after an interrupted call
+	err = client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+
+	// the late response of the abandoned call is dropped
+	time.Sleep(time.Millisecond * 60)
+	recvCtx, recvCancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer recvCancel()
+	_, err = client.Recv(recvCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+	err = client.Call(ctx, &pb.Error{Code: 400}, &res)
+	assert.Equal(t, context.Canceled, err)
+
+	// closed client
+	client.Close()
+	err = client.Send(context.Background(), &pb.Ping{Message: "Ping"})
+	assert.Error(t, err)
+}
+
+func TestClientMultiplexing(t *testing.T) {
+	server, addr := serveTestRouter(t)
+	defer server.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			var res Request
+			err := client.Call(context.Background(), &pb.Ping{Message: "Ping" + strconv.Itoa(idx)}, &res)
+			assert.NoError(t, err)
+			assert.NotZero(t, res.StreamID)
+
+			var pong pb.Ping
+			proto.Unmarshal(res.Data.([]byte), &pong)
+			assert.Equal(t, "Pong"+strconv.Itoa(idx), pong.GetMessage())
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientClose(t *testing.T) {
+	server, addr := serveTestRouter(t)
+	defer server.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	var res Request
+	err = client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+	assert.Equal(t, ErrClientClosed, err)
+	_, err = client.Recv(context.Background())
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func TestClientRecvQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go func() {
+		ReadPreface(c2)
+		go io.Copy(io.Discard, c2)
+		WritePreface(c2, ProtocolVersion)
+
+		// the message of the stream never issued is dropped,
+		// and the ones exceeding the queue
+		w := newBufioWriter(c2)
+		for i, id := range []uint32{5, 0, 0, 0} {
+			payload, _ := (&ProtobufCodec{}).Marshal(&pb.Ping{Message: strconv.Itoa(i)})
+			writeData(w, id, payload)
+		}
+		w.Flush()
+	}()
+
+	drops := make(chan string, 2)
+	client := (&Dialer{
+		Codec:        &ProtobufCodec{},
+		MaxRecvQueue: 2,
+		OnRecvDrop:   func(_ *Client, res *Request) { drops <- readPingMessage(*res) },
+	}).NewClient(c1)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, msg := range []string{"1", "2"} {
+		res, err := client.Recv(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, readPingMessage(*res))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, err := client.Recv(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the drops are counted and reported
+	assert.Equal(t, "0", <-drops)
+	assert.Equal(t, "3", <-drops)
+	assert.Equal(t, uint64(2), client.RecvDrops())
+}
@@ -0,0 +1,203 @@
+package gotham
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrCompression is returned when a compressed message can not be
+// decompressed, the framing of the connection is still intact.
+var ErrCompression = errors.New("tcp: compression error")
+
+// DefaultCompressThreshold is the size of the smallest message compressed,
+// when the threshold is not set on the Server or the Dialer.
+const DefaultCompressThreshold = 1 << 10
+
+// A Compressor compresses the messages written, and decompresses the
+// messages read, which are flagged with FlagDataCompressed.
+// The messages are compressed only if both of the peers use the
+// compressor with the same id, which is announced by SettingCompressor.
+type Compressor interface {
+	// ID identifies the compressor, see CompressorDeflate and CompressorGzip.
+	ID() uint32
+	// NewWriter returns a writer, which compresses the data written into w.
+	// The writer is not used after it is closed, so it may be recycled.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader, which decompresses the data read from r.
+	// If the reader is an io.Closer, it is closed once the message is read,
+	// and not used after it, so it may be recycled.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// The ids of the compressors shipped with the package, which
+// are announced by SettingCompressor.
+const (
+	CompressorDeflate uint32 = 0x1
+	CompressorGzip    uint32 = 0x2
+)
+
+// DeflateCompressor compresses the messages with DEFLATE, see compress/flate.
+// The writers and the readers are recycled, once they are closed.
+type DeflateCompressor struct {
+	// Level is the compression level, if zero, flate.DefaultCompression is used.
+	Level int
+
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// ID returns CompressorDeflate.
+func (dc *DeflateCompressor) ID() uint32 {
+	return CompressorDeflate
+}
+
+// NewWriter returns a flate.Writer.
+func (dc *DeflateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if zw, ok := dc.writers.Get().(*pooledWriter); ok {
+		zw.reset(w)
+		return zw, nil
+	}
+	fw, err := flate.NewWriter(w, compressLevel(dc.Level))
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{resetWriter: fw, pool: &dc.writers}, nil
+}
+
+// NewReader returns a flate reader.
+func (dc *DeflateCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	if zr, ok := dc.readers.Get().(*pooledReader); ok {
+		if err := zr.reset(r); err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	fr := flate.NewReader(r)
+	return &pooledReader{
+		ReadCloser: fr,
+		resetFunc: func(r io.Reader) error {
+			return fr.(flate.Resetter).Reset(r, nil)
+		},
+		pool: &dc.readers,
+	}, nil
+}
+
+// GzipCompressor compresses the messages with gzip, see compress/gzip.
+// The writers and the readers are recycled, once they are closed.
+type GzipCompressor struct {
+	// Level is the compression level, if zero, gzip.DefaultCompression is used.
+	Level int
+
+	writers sync.Pool
+	readers sync.Pool
+}
+
+// ID returns CompressorGzip.
+func (gc *GzipCompressor) ID() uint32 {
+	return CompressorGzip
+}
+
+// NewWriter returns a gzip.Writer.
+func (gc *GzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if zw, ok := gc.writers.Get().(*pooledWriter); ok {
+		zw.reset(w)
+		return zw, nil
+	}
+	gw, err := gzip.NewWriterLevel(w, compressLevel(gc.Level))
+	if err != nil {
+		return nil, err
+	}
+	return &pooledWriter{resetWriter: gw, pool: &gc.writers}, nil
+}
+
+// NewReader returns a gzip.Reader.
+func (gc *GzipCompressor) NewReader(r io.Reader) (io.Reader, error) {
+	if zr, ok := gc.readers.Get().(*pooledReader); ok {
+		if err := zr.reset(r); err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledReader{ReadCloser: gr, resetFunc: gr.Reset, pool: &gc.readers}, nil
+}
+
+// resetWriter is implemented by flate.Writer and gzip.Writer.
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// pooledWriter returns the writer to the pool of its compressor,
+// once it is closed.
+type pooledWriter struct {
+	resetWriter
+	pool   *sync.Pool
+	closed bool
+}
+
+func (zw *pooledWriter) reset(w io.Writer) {
+	zw.Reset(w)
+	zw.closed = false
+}
+
+func (zw *pooledWriter) Close() error {
+	if zw.closed {
+		return nil
+	}
+	zw.closed = true
+	err := zw.resetWriter.Close()
+	zw.Reset(nil)
+	zw.pool.Put(zw)
+	return err
+}
+
+// pooledReader returns the reader to the pool of its compressor,
+// once it is closed.
+type pooledReader struct {
+	io.ReadCloser
+	resetFunc func(r io.Reader) error
+	pool      *sync.Pool
+	closed    bool
+}
+
+func (zr *pooledReader) reset(r io.Reader) error {
+	if err := zr.resetFunc(r); err != nil {
+		// the reader is still reusable, it is reset by the next message
+		zr.pool.Put(zr)
+		return err
+	}
+	zr.closed = false
+	return nil
+}
+
+func (zr *pooledReader) Close() error {
+	if zr.closed {
+		return nil
+	}
+	zr.closed = true
+	err := zr.ReadCloser.Close()
+	zr.pool.Put(zr)
+	return err
+}
+
+func compressLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// compressorID returns the id of the compressor, or zero if it is nil.
+func compressorID(cp Compressor) uint32 {
+	if cp != nil {
+		return cp.ID()
+	}
+	return 0
+}
@@ -0,0 +1,184 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressor(t *testing.T) {
+	msg := bytes.Repeat([]byte("gotham"), 1000)
+
+	for _, cp := range []Compressor{&DeflateCompressor{}, &GzipCompressor{Level: 9}} {
+		fr := &Framer{Compressor: cp, MaxWriteFrameSize: 64}
+		var buf bytes.Buffer
+
+		// the message is compressed, before it is split
+		assert.NoError(t, fr.writeData(&buf, 1, msg))
+		fh, err := ReadFrameHeader(&buf)
+		assert.NoError(t, err)
+		assert.True(t, fh.Flags.Has(FlagDataCompressed))
+		assert.True(t, buf.Len() < len(msg))
+
+		payload, err := fr.readMessage(&buf, fh)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, *payload)
+
+		// the small message is not compressed
+		fr.WriteData(&buf, msg[:64])
+		fh, _ = ReadFrameHeader(&buf)
+		assert.False(t, fh.Flags.Has(FlagDataCompressed))
+		assert.Equal(t, uint32(64), fh.Length)
+		readFramePayload(&buf, fh)
+
+		// neither the message, which can not be compressed
+		random := make([]byte, 2048)
+		rand.Read(random)
+		fr.WriteData(&buf, random)
+		fh, _ = ReadFrameHeader(&buf)
+		assert.False(t, fh.Flags.Has(FlagDataCompressed))
+		payload, err = fr.readMessage(&buf, fh)
+		assert.NoError(t, err)
+		assert.Equal(t, random, *payload)
+
+		// the decompressed message is limited as well
+		fr.WriteData(&buf, msg)
+		fh, _ = ReadFrameHeader(&buf)
+		_, err = (&Framer{Compressor: cp, MaxReadMessageSize: 1024}).readMessage(&buf, fh)
+		assert.Equal(t, ErrMessageTooLarge, err)
+
+		// the compressed message can not be read without the compressor
+		fr.WriteData(&buf, msg)
+		fh, _ = ReadFrameHeader(&buf)
+		_, err = defaultFramer.readMessage(&buf, fh)
+		assert.True(t, errors.Is(err, ErrCompression))
+	}
+}
+
+func TestCompressorReuse(t *testing.T) {
+	for _, cp := range []Compressor{&DeflateCompressor{}, &GzipCompressor{}} {
+		fr := &Framer{Compressor: cp}
+
+		// the writers and the readers recycled are reset for each message
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 16; j++ {
+					msg := bytes.Repeat([]byte(strconv.Itoa(i*16+j)), 2000)
+					var buf bytes.Buffer
+					assert.NoError(t, fr.writeData(&buf, 1, msg))
+					fh, _ := ReadFrameHeader(&buf)
+					assert.True(t, fh.Flags.Has(FlagDataCompressed))
+					payload, err := fr.readMessage(&buf, fh)
+					assert.NoError(t, err)
+					assert.Equal(t, msg, *payload)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// the reader recycled after the corrupted message still works
+		_, err := fr.decompress([]byte("corrupted"))
+		assert.True(t, errors.Is(err, ErrCompression))
+		data, ok, err := fr.compress(bytes.Repeat([]byte("gotham"), 100))
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		fb, err := fr.decompress(data)
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("gotham"), 100), fb)
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	addr := "127.0.0.1:9005"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: strings.Repeat(readPingMessage(*c.Request), 100)})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.Compressor = &GzipCompressor{}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	// the responses are not compressed, until the client agrees
+	WriteFrame(w, &pb.Ping{Message: "Ping"}, &ProtobufCodec{})
+	w.Flush()
+	fh, err := ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.False(t, fh.Flags.Has(FlagDataCompressed))
+	readFramePayload(r, fh)
+
+	writeFrame(w, FrameHeader{Type: FrameSettings}, encodeSettings([]Setting{
+		{ID: SettingCompressor, Val: CompressorGzip},
+	}))
+	w.Flush()
+	fh, _ = ReadFrameHeader(r)
+	payload, _ := readFramePayload(r, fh)
+	settings, _ := decodeSettings(payload)
+	var cs connSettings
+	cs.apply(settings)
+	assert.Equal(t, CompressorGzip, cs.compressor)
+
+	fr := &Framer{Compressor: &GzipCompressor{}}
+	fr.WriteFrame(w, &pb.Ping{Message: strings.Repeat("Ping", 1000)}, &ProtobufCodec{})
+	w.Flush()
+	fh, err = ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.True(t, fh.Flags.Has(FlagDataCompressed))
+	res, err := fr.ReadFrameBody(r, fh, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("Ping", 100000), readPingMessage(*res))
+}
+
+func TestClientCompression(t *testing.T) {
+	addr := "127.0.0.1:9005"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: strings.Repeat(readPingMessage(*c.Request), 100)})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.Compressor = &DeflateCompressor{}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	for _, cp := range []Compressor{&DeflateCompressor{}, &GzipCompressor{}, nil} {
+		client, err := (&Dialer{Codec: &ProtobufCodec{}, Compressor: cp}).Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, client.UpdateSettings(context.Background()))
+		_, ok := client.getFramer().Compressor.(*DeflateCompressor)
+		assert.Equal(t, compressorID(cp) == CompressorDeflate, ok)
+
+		// the response is split into the frames, if it is not compressed
+		var res Request
+		assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: strings.Repeat("a", 1000)}, &res))
+		assert.Equal(t, 100000, len(readPingMessage(res)))
+		client.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package gotham
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ErrCodec is returned when a message can not be decoded by the codec.
+// The errors returned are of type *CodecError, which matches ErrCodec
+// with errors.Is.
+var ErrCodec = errors.New("tcp: codec error")
+
+// CodecError is returned when a message can not be decoded by the codec.
+type CodecError struct {
+	// Err is the error returned by the codec.
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrCodec, e.Err)
+}
+
+// Unwrap returns the error returned by the codec.
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrCodec.
+func (e *CodecError) Is(target error) bool {
+	return target == ErrCodec
+}
+
+// ConnError is the error closing a connection of the Server,
+// which is reported by the Server's OnConnError.
+type ConnError struct {
+	// Op is the operation failed, such as "handshake", "preface", "auth", "read" or "write".
+	Op string
+	// Code classifies the error, it is sent to the client by
+	// the GOAWAY frame, if the Server's SendGoAwayOnError is set.
+	Code ErrCode
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("tcp: %s error: %v (%v)", e.Op, e.Err, e.Code)
+}
+
+// Unwrap returns the underlying error.
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the error is a timeout.
+func (e *ConnError) Timeout() bool {
+	return e.Code == ErrCodeTimeout
+}
+
+// errCode classifies the error closing a connection.
+func errCode(err error) ErrCode {
+	var ne net.Error
+	switch {
+	case errors.Is(err, ErrFrameTooLarge), errors.Is(err, ErrFrameSize),
+		err == ErrMessageTooLarge:
+		return ErrCodeFrameSize
+	case errors.Is(err, ErrCodec):
+		return ErrCodeCodec
+	case errors.Is(err, ErrFrameFlags), err == ErrContinuation,
+		err == ErrPreface, err == ErrVersion, err == ErrCodecMismatch,
+		err == ErrHandshake:
+		return ErrCodeProtocol
+	case err == ErrAuthFailed, err == ErrAuthTimeout:
+		return ErrCodeAuth
+	case errors.As(err, &ne) && ne.Timeout():
+		return ErrCodeTimeout
+	}
+	// the broken connections, and the errors of the server itself
+	return ErrCodeInternal
+}
+
+// connError reports the error, which closes the connection, by the
+// Server's OnConnError. The client is told the error by the GOAWAY
+// frame, if the error is not of the connection itself.
+func (c *conn) connError(op string, err error) {
+	// the connections closed by the peer or the server itself are not errors
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return
+	}
+
+	ce := &ConnError{Op: op, Code: errCode(err), Err: err}
+	c.server.logf("tcp: closing connection from %v: %v", c.remoteAddr, ce)
+
+	// the frame can not be written after the write errors
+	if c.server.SendGoAwayOnError && (op == "read" || op == "auth") && ce.Code != ErrCodeInternal {
+		c.goAway(ce.Code)
+	}
+	if hook := c.server.OnConnError; hook != nil {
+		hook(c.rwc, ce)
+	}
+}
@@ -0,0 +1,136 @@
+package gotham
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrCode(t *testing.T) {
+	var timeout net.Error = &net.OpError{Op: "read", Err: timeoutError{}}
+	for err, code := range map[error]ErrCode{
+		ErrFrameFlags:                          ErrCodeProtocol,
+		ErrPreface:                             ErrCodeProtocol,
+		ErrFrameSize:                           ErrCodeFrameSize,
+		&FrameTooLargeError{Length: 2, Max: 1}: ErrCodeFrameSize,
+		&CodecError{Err: io.ErrShortBuffer}:    ErrCodeCodec,
+		timeout:                                ErrCodeTimeout,
+		ErrAuthTimeout:                         ErrCodeAuth,
+		io.ErrUnexpectedEOF:                    ErrCodeInternal,
+	} {
+		assert.Equal(t, code, errCode(err), err.Error())
+	}
+
+	var err error = &CodecError{Err: io.ErrShortBuffer}
+	assert.True(t, errors.Is(err, ErrCodec))
+	assert.True(t, errors.Is(err, io.ErrShortBuffer))
+
+	ce := &ConnError{Op: "read", Code: ErrCodeTimeout, Err: timeout}
+	assert.True(t, ce.Timeout())
+	assert.Equal(t, "tcp: read error: read: i/o timeout (TIMEOUT)", ce.Error())
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// readGoAway reads the frames until the GOAWAY frame, and returns its code.
+func readGoAway(t *testing.T, r *bufio.Reader) ErrCode {
+	for {
+		fh, err := ReadFrameHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readFramePayload(r, fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fh.Type == FrameGoAway {
+			return ErrCode(binary.BigEndian.Uint32(payload[4:]))
+		}
+	}
+}
+
+func TestServerConnError(t *testing.T) {
+	addr := "127.0.0.1:9009"
+	connErrors := make(chan *ConnError, 1)
+	server := &Server{Addr: addr, Handler: New(), Codec: &ProtobufCodec{}}
+	server.ReadTimeout = time.Millisecond * 100
+	server.SendGoAwayOnError = true
+	server.OnConnError = func(_ net.Conn, err *ConnError) { connErrors <- err }
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	dial := func(preface bool) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preface {
+			exchangePreface(t, conn)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+
+	// the frame without FlagFrameAck
+	conn, r := dial(true)
+	conn.Write([]byte{0, 0, 0, byte(FrameData), 0})
+	assert.Equal(t, ErrCodeProtocol, readGoAway(t, r))
+	ce := <-connErrors
+	assert.Equal(t, "read", ce.Op)
+	assert.True(t, errors.Is(ce, ErrFrameFlags))
+	_, err := r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	// the message the codec can not decode
+	conn, r = dial(true)
+	writeFrame(conn, FrameHeader{Type: FrameData}, []byte{0xff, 0xff})
+	assert.Equal(t, ErrCodeCodec, readGoAway(t, r))
+	ce = <-connErrors
+	assert.True(t, errors.Is(ce, ErrCodec))
+	conn.Close()
+
+	// the ping of invalid size
+	conn, r = dial(true)
+	writeFrame(conn, FrameHeader{Type: FramePing}, []byte{0x1})
+	assert.Equal(t, ErrCodeFrameSize, readGoAway(t, r))
+	assert.Equal(t, ErrCodeFrameSize, (<-connErrors).Code)
+	conn.Close()
+
+	// the peer without the preface is not told anything
+	conn, r = dial(false)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, err = r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	ce = <-connErrors
+	assert.Equal(t, "preface", ce.Op)
+	assert.Equal(t, ErrPreface, ce.Err)
+	conn.Close()
+
+	// the peer closing the connection is not an error
+	conn, _ = dial(true)
+	conn.Close()
+
+	// the idle peer told about the timeout
+	conn, r = dial(true)
+	assert.Equal(t, ErrCodeTimeout, readGoAway(t, r))
+	assert.True(t, (<-connErrors).Timeout())
+	conn.Close()
+
+	select {
+	case ce := <-connErrors:
+		t.Fatalf("unexpected error: %v", ce)
+	default:
+	}
+}
@@ -0,0 +1,139 @@
+package gotham
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a connection of the Server, so the logs, the metrics
+// and the sessions may refer to the connection, rather than its address,
+// which may be shared by the clients behind the same NAT.
+type ConnInfo struct {
+	// ID identifies the connection in the Server, see Server.Conn.
+	ID uint64
+
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// ConnectedAt is the time the connection was accepted.
+	ConnectedAt time.Time
+
+	// Transport is the type of the underlying connection, such as "tcp",
+	// "unix", "udp" of the kcp sessions, "tls" or "secure", see SecureConn.
+	Transport string
+
+	// ProtoVersion is the protocol version negotiated with the client.
+	ProtoVersion uint8
+	// Codec is the id of the Server's codec, see CodecProtobuf.
+	Codec uint32
+	// Compressor is the id of the compressor negotiated with the client,
+	// or zero if the messages are not compressed.
+	Compressor uint32
+
+	// BytesRead and BytesWritten count the bytes of the connection,
+	// including the frame headers and the control frames.
+	BytesRead    uint64
+	BytesWritten uint64
+	// MessagesRead counts the requests read, and MessagesWritten
+	// counts the messages written, including the ones pushed.
+	MessagesRead    uint64
+	MessagesWritten uint64
+}
+
+// transport returns the type of the connection, see ConnInfo.Transport.
+func transport(nc net.Conn) string {
+	switch nc.(type) {
+	case *tls.Conn:
+		return "tls"
+	case *SecureConn:
+		return "secure"
+	}
+	if addr := nc.LocalAddr(); addr != nil {
+		return addr.Network()
+	}
+	return ""
+}
+
+// info returns a snapshot of the connection.
+func (c *conn) info() ConnInfo {
+	// the version is negotiated before the conn is ready for the pushes,
+	// it is read after pushReady, without waiting for the writes under wmu
+	var version uint8
+	c.pushMu.Lock()
+	ready := c.pushReady
+	c.pushMu.Unlock()
+	if ready {
+		version = c.version
+	}
+
+	return ConnInfo{
+		ID:              c.id,
+		RemoteAddr:      c.rwc.RemoteAddr(),
+		LocalAddr:       c.rwc.LocalAddr(),
+		ConnectedAt:     c.connectedAt,
+		Transport:       transport(c.rwc),
+		ProtoVersion:    version,
+		Codec:           codecID(c.server.Codec),
+		Compressor:      compressorID(c.getFramer().Compressor),
+		BytesRead:       atomic.LoadUint64(&c.bytesRead),
+		BytesWritten:    atomic.LoadUint64(&c.bytesWritten),
+		MessagesRead:    atomic.LoadUint64(&c.messagesRead),
+		MessagesWritten: atomic.LoadUint64(&c.messagesWritten),
+	}
+}
+
+// Info returns a snapshot of the connection, see ConnInfo.
+func (hc *Conn) Info() ConnInfo {
+	return hc.c.info()
+}
+
+// ConnID returns the id of the connection the request was read from,
+// which is unique in the Server, or zero if there is no connection.
+func (req *Request) ConnID() uint64 {
+	if req.conn != nil {
+		return req.conn.id
+	}
+	return 0
+}
+
+// LocalAddr returns the local address of the connection the request
+// was read from, or "0.0.0.0" if there is no connection.
+func (req *Request) LocalAddr() string {
+	if req.conn != nil {
+		return req.conn.rwc.LocalAddr().String()
+	}
+	return "0.0.0.0"
+}
+
+// ConnInfo returns a snapshot of the connection the request was read from.
+// The counters include the request itself.
+func (req *Request) ConnInfo() ConnInfo {
+	if req.conn != nil {
+		return req.conn.info()
+	}
+	return ConnInfo{}
+}
+
+// countReader counts the bytes read from the connection.
+type countReader struct {
+	c *conn
+}
+
+func (r countReader) Read(p []byte) (int, error) {
+	n, err := r.c.rwc.Read(p)
+	atomic.AddUint64(&r.c.bytesRead, uint64(n))
+	return n, err
+}
+
+// countWriter counts the bytes written to the connection.
+type countWriter struct {
+	c *conn
+}
+
+func (w countWriter) Write(p []byte) (int, error) {
+	n, err := w.c.rwc.Write(p)
+	atomic.AddUint64(&w.c.bytesWritten, uint64(n))
+	return n, err
+}
@@ -0,0 +1,77 @@
+package gotham
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestConnInfo(t *testing.T) {
+	addr := "127.0.0.1:9015"
+	infos := make(chan ConnInfo, 2)
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		assert.Equal(t, c.Conn().ID(), c.Request.ConnID())
+		assert.Equal(t, addr, c.Request.LocalAddr())
+		infos <- c.Request.ConnInfo()
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}, Compressor: &GzipCompressor{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	start := time.Now()
+	client, err := (&Dialer{Codec: &ProtobufCodec{}, Compressor: &GzipCompressor{}}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	info := <-infos
+	assert.NotZero(t, info.ID)
+	assert.Equal(t, client.rwc.LocalAddr().String(), info.RemoteAddr.String())
+	assert.Equal(t, addr, info.LocalAddr.String())
+	assert.WithinDuration(t, start, info.ConnectedAt, time.Second)
+	assert.Equal(t, "tcp", info.Transport)
+	assert.Equal(t, ProtocolVersion, info.ProtoVersion)
+	assert.Equal(t, CodecProtobuf, info.Codec)
+	assert.Equal(t, (&GzipCompressor{}).ID(), info.Compressor)
+	assert.True(t, info.BytesRead > 0)
+	assert.Equal(t, uint64(1), info.MessagesRead)
+	assert.Equal(t, uint64(0), info.MessagesWritten)
+
+	// the counters grow with the requests, and the pushes
+	hc, ok := server.Conn(info.ID)
+	assert.True(t, ok)
+	assert.NoError(t, hc.Push(&pb.Ping{Message: "push"}))
+	_, err = client.Recv(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	info = <-infos
+	assert.Equal(t, uint64(2), info.MessagesRead)
+	assert.Equal(t, uint64(2), info.MessagesWritten)
+	assert.True(t, info.BytesWritten > 0)
+
+	// the requests without the connection
+	var req Request
+	assert.Equal(t, uint64(0), req.ConnID())
+	assert.Equal(t, "0.0.0.0", req.LocalAddr())
+	assert.Equal(t, ConnInfo{}, req.ConnInfo())
+}
+
+func TestTransport(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	assert.Equal(t, "pipe", transport(c1))
+	assert.Equal(t, "secure", transport(&SecureConn{Conn: c1}))
+}
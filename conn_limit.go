@@ -0,0 +1,99 @@
+package gotham
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMaxConns is reported by the Server's OnReject, when a connection is
+// rejected for the Server's MaxConns.
+var ErrMaxConns = errors.New("tcp: too many connections")
+
+// ErrMaxConnsPerIP is reported by the Server's OnReject, when a connection
+// is rejected for the Server's MaxConnsPerIP.
+var ErrMaxConnsPerIP = errors.New("tcp: too many connections from the IP")
+
+// rejectTimeout limits the time of writing the GOAWAY frame to the
+// connection rejected, and of waiting for the client to close it.
+const rejectTimeout = time.Second
+
+// maxRejecting is the number of the GOAWAY frames written to the
+// connections rejected at once. The connections rejected beyond it
+// are closed immediately, so a flood of them holds no more goroutines.
+const maxRejecting = 64
+
+// remoteIP returns the IP of the remote address, which keys MaxConnsPerIP.
+func remoteIP(nc net.Conn) string {
+	if nc == nil || nc.RemoteAddr() == nil {
+		return ""
+	}
+	addr := nc.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admitConn tracks the new connection, unless it exceeds the limits
+// of the connections, in which case the error of the limit is returned.
+func (srv *Server) admitConn(c *conn) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if max := srv.MaxConns; max > 0 && len(srv.activeConn) >= max {
+		return ErrMaxConns
+	}
+	if max := srv.MaxConnsPerIP; max > 0 && c.remoteIP != "" && srv.connsPerIP[c.remoteIP] >= max {
+		return ErrMaxConnsPerIP
+	}
+	srv.trackConnLocked(c, true)
+	return nil
+}
+
+// RejectedConns returns the number of the connections rejected by
+// MaxConns and MaxConnsPerIP, see OnReject.
+func (srv *Server) RejectedConns() uint64 {
+	return atomic.LoadUint64(&srv.rejected)
+}
+
+// rejectConn reports the connection rejected by OnReject, and closes it.
+// The client is told the rejection by the GOAWAY frame with ErrCodeRefused,
+// if SendGoAwayOnError is set, which is written without blocking Serve,
+// unless maxRejecting frames are being written already.
+func (srv *Server) rejectConn(rw net.Conn, err error) {
+	atomic.AddUint64(&srv.rejected, 1)
+	if hook := srv.OnReject; hook != nil {
+		hook(rw, err)
+	}
+
+	// the secure handshake is never done for the rejected connection
+	if !srv.SendGoAwayOnError || srv.SecureConfig != nil {
+		rw.Close()
+		return
+	}
+	if atomic.AddInt32(&srv.rejecting, 1) > maxRejecting {
+		atomic.AddInt32(&srv.rejecting, -1)
+		rw.Close()
+		return
+	}
+
+	go func() {
+		defer atomic.AddInt32(&srv.rejecting, -1)
+		defer rw.Close()
+		rw.SetDeadline(time.Now().Add(rejectTimeout))
+		if err := WritePreface(rw, ProtocolVersion); err != nil {
+			return
+		}
+		if err := writeFrame(rw, FrameHeader{Type: FrameGoAway}, encodeGoAway(0, ErrCodeRefused)); err != nil {
+			return
+		}
+		// wait for the client to close, so the frame is not lost
+		// by resetting the connection with the data unread
+		if cw, ok := rw.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		io.Copy(io.Discard, rw)
+	}()
+}
@@ -0,0 +1,174 @@
+package gotham
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConns(t *testing.T) {
+	addr := "127.0.0.1:9017"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+
+	rejected := make(chan error, 1)
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.MaxConns = 1
+	server.SendGoAwayOnError = true
+	server.OnReject = func(_ net.Conn, err error) { rejected <- err }
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	dial := func() *Client {
+		client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	var res Request
+	c1 := dial()
+	assert.NoError(t, c1.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+
+	// the client exceeding the limit is told by the GOAWAY frame
+	c2 := dial()
+	err := c2.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+	var ga *GoAwayError
+	assert.True(t, errors.As(err, &ga))
+	assert.Equal(t, ErrCodeRefused, ga.Code)
+	assert.Equal(t, ErrMaxConns, <-rejected)
+	c2.Close()
+
+	// the connection is closed immediately, while too many
+	// GOAWAY frames are being written
+	atomic.AddInt32(&server.rejecting, maxRejecting)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadPreface(conn)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, ErrMaxConns, <-rejected)
+	conn.Close()
+	atomic.AddInt32(&server.rejecting, -maxRejecting)
+	assert.Equal(t, uint64(2), server.RejectedConns())
+
+	// the connection is accepted, once the first one is closed
+	c1.Close()
+	assert.Eventually(t, func() bool {
+		return len(server.Conns()) == 0
+	}, time.Second, time.Millisecond*5)
+	c3 := dial()
+	defer c3.Close()
+	assert.NoError(t, c3.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	addr := "127.0.0.1:9018"
+	rejected := make(chan error, 1)
+	server := &Server{Addr: addr, Handler: New(), Codec: &ProtobufCodec{}}
+	server.MaxConnsPerIP = 2
+	server.OnReject = func(_ net.Conn, err error) { rejected <- err }
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	for i := 0; i < 2; i++ {
+		conn := dial()
+		defer conn.Close()
+		exchangePreface(t, conn)
+	}
+
+	// the connection exceeding the limit is closed immediately
+	conn := dial()
+	defer conn.Close()
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, ErrMaxConnsPerIP, <-rejected)
+	assert.Equal(t, uint64(1), server.RejectedConns())
+
+	server.mu.Lock()
+	assert.Equal(t, map[string]int{"127.0.0.1": 2}, server.connsPerIP)
+	server.mu.Unlock()
+}
+
+func TestCloseUntracksConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+	server := &Server{Handler: router, Codec: &ProtobufCodec{}}
+	go server.Serve(ln)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		exchangePreface(t, conn)
+		WriteFrame(conn, &pb.Ping{Message: "Ping"}, &ProtobufCodec{})
+		_, err = ReadFrame(conn, &ProtobufCodec{})
+		assert.NoError(t, err)
+		conns = append(conns, conn)
+	}
+
+	// the idle connections closed by Shutdown are untracked
+	for deadline := time.Now().Add(time.Second); !server.closeIdleConns(); {
+		if time.Now().After(deadline) {
+			t.Fatal("the conns are not idle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, conn := range conns {
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+	}
+	server.mu.Lock()
+	assert.Equal(t, 0, len(server.activeConn))
+	assert.Equal(t, 0, len(server.connByID))
+	assert.Equal(t, 0, len(server.connsPerIP))
+	server.mu.Unlock()
+
+	// and the ones closed by Close
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchangePreface(t, conn)
+	server.Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	server.mu.Lock()
+	assert.Equal(t, 0, len(server.activeConn))
+	assert.Equal(t, 0, len(server.connByID))
+	assert.Equal(t, 0, len(server.connsPerIP))
+	server.mu.Unlock()
+}
@@ -14,6 +14,7 @@ type Context struct {
 	index    int8
 
 	// Keys is a key/value pair exclusively for the context of each request.
+	// The values kept across the requests are stored in the Session.
 	Keys map[string]interface{}
 
 	// Errors is a list of Errors attached to all the handlers/middlewares who used this context.
@@ -247,6 +248,12 @@ func (c *Context) Write(msg interface{}) error {
 	return c.Writer.Write(msg)
 }
 
+// Flush writes the messages written to the connection immediately,
+// regardless of the Server's FlushPolicy.
+func (c *Context) Flush() error {
+	return c.Writer.Flush()
+}
+
 func (c *Context) writeError(code int, message interface{}) error {
 	// c.Writer.SetClose(close)
 	c.Writer.SetStatus(code)
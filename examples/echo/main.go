@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -51,7 +51,7 @@ func main() {
 			defer wg.Done()
 
 			// Connect to server.
-			client, err := net.Dial("tcp", addr)
+			client, err := gotham.Dial("tcp", addr, &gotham.ProtobufCodec{})
 			if err != nil {
 				log.Fatal("can not get in touch with gotham.")
 			}
@@ -62,14 +62,10 @@ func main() {
 				Ts:      ptypes.TimestampNow(),
 			}
 
-			// Write the message with a little help of gotham utils function.
-			if err := gotham.WriteFrame(client, msg, &gotham.ProtobufCodec{}); err != nil {
-				log.Fatalf("client write data error: %s.", err)
-			}
-
-			res, err := gotham.ReadFrame(client, &gotham.ProtobufCodec{})
-			if err != nil {
-				log.Fatalf("client read data error: %s.", err)
+			// Write the message and wait for the response of it.
+			var res gotham.Request
+			if err := client.Call(context.Background(), msg, &res); err != nil {
+				log.Fatalf("client call error: %s.", err)
 			}
 			// Unmarshal the raw data
 			err = proto.Unmarshal(res.Data.([]byte), msg)
@@ -10,6 +10,11 @@ import (
 type FlatbuffersCodec struct {
 }
 
+// ID returns the id of the codec announced in the SETTINGS frame.
+func (pc *FlatbuffersCodec) ID() uint32 {
+	return CodecFlatbuffers
+}
+
 func (pc *FlatbuffersCodec) Unmarshal(data []byte, req *Request) error {
 	// fmt.Println("unmarhsal")
 	msgt := fbs.GetRootAsMessage(data, 0).UnPack()
@@ -79,6 +79,7 @@ func TestFlatbuffersCodec(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	exchangePreface(t, conn)
 
 	now := time.Now().Unix()
 	ping := &fbs.PingT{
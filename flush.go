@@ -0,0 +1,152 @@
+package gotham
+
+import (
+	"net"
+	"time"
+)
+
+// FlushPolicy decides when the responses written by the handlers are
+// flushed to the connection, see Server.FlushPolicy.
+type FlushPolicy int
+
+const (
+	// FlushPerRequest flushes the responses after the handler returns.
+	// The responses of the requests handled concurrently are flushed
+	// together, if they are finished at the same time.
+	FlushPerRequest FlushPolicy = iota
+	// FlushPerMessage flushes every message, once it is written.
+	FlushPerMessage
+	// FlushCoalesce coalesces the responses across the requests, they are
+	// flushed once FlushSize bytes are buffered, or FlushDelay after the
+	// first response buffered.
+	FlushCoalesce
+)
+
+// defaultFlushDelay is used by FlushCoalesce, if the FlushDelay is zero.
+const defaultFlushDelay = time.Millisecond
+
+func (p FlushPolicy) String() string {
+	switch p {
+	case FlushPerRequest:
+		return "per-request"
+	case FlushPerMessage:
+		return "per-message"
+	case FlushCoalesce:
+		return "coalesce"
+	}
+	return "unknown"
+}
+
+func (srv *Server) flushDelay() time.Duration {
+	if srv.FlushDelay > 0 {
+		return srv.FlushDelay
+	}
+	return defaultFlushDelay
+}
+
+// flushLocked flushes the responses buffered, wmu must be held.
+func (c *conn) flushLocked() error {
+	c.flushPending = false
+	if c.bufw.Buffered() == 0 {
+		return nil
+	}
+	if d := c.server.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+	return c.bufw.Flush()
+}
+
+// flushResponsesLocked flushes the responses of the requests handled,
+// by the FlushPolicy of the server, wmu must be held. The responses
+// are always flushed, if the connection is closing.
+func (c *conn) flushResponsesLocked(keepAlive bool) error {
+	if c.bufw.Buffered() == 0 {
+		return nil
+	}
+
+	size := c.server.FlushSize
+	if size <= 0 {
+		size = c.bufw.Size()
+	}
+	if c.server.FlushPolicy != FlushCoalesce || !keepAlive || c.bufw.Buffered() >= size {
+		return c.flushLocked()
+	}
+
+	// the responses are flushed by the timer, with the ones following them
+	if !c.flushPending {
+		c.flushPending = true
+		if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(c.server.flushDelay(), c.flushDelayed)
+		} else {
+			c.flushTimer.Reset(c.server.flushDelay())
+		}
+	}
+	return nil
+}
+
+// flushDelayed flushes the responses coalesced, when the FlushDelay elapses.
+func (c *conn) flushDelayed() {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// the writer is flushed already, or released by the closed connection
+	if !c.flushPending || c.bufw == nil {
+		return
+	}
+	if err := c.flushLocked(); err != nil {
+		c.connError("write", err)
+		c.rwc.Close()
+	}
+}
+
+// connWriter writes the responses of the requests handled one at a time
+// into bufw of the connection. Each message is framed under wmu, so the
+// frames written by the other goroutines never interleave with its frames.
+type connWriter struct {
+	c *conn
+}
+
+// writeMessage frames the message into bufw, see messageWriter.
+func (cw connWriter) writeMessage(fr *Framer, streamID uint32, data []byte) error {
+	c := cw.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw == nil {
+		return net.ErrClosed
+	}
+	if d := c.server.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+	return fr.writeData(c.bufw, streamID, data)
+}
+
+func (cw connWriter) Write(p []byte) (int, error) {
+	c := cw.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw == nil {
+		return 0, net.ErrClosed
+	}
+	return c.bufw.Write(p)
+}
+
+// Buffered returns the number of bytes not flushed yet.
+func (cw connWriter) Buffered() int {
+	c := cw.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw == nil {
+		return 0
+	}
+	return c.bufw.Buffered()
+}
+
+// Flush writes the responses to the connection immediately.
+func (cw connWriter) Flush() error {
+	c := cw.c
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw == nil {
+		return net.ErrClosed
+	}
+	return c.flushLocked()
+}
@@ -0,0 +1,192 @@
+package gotham
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushPolicyString(t *testing.T) {
+	assert.Equal(t, "per-request", FlushPerRequest.String())
+	assert.Equal(t, "per-message", FlushPerMessage.String())
+	assert.Equal(t, "coalesce", FlushCoalesce.String())
+	assert.Equal(t, "unknown", FlushPolicy(-1).String())
+}
+
+// flushTestServer starts a server, whose handler writes the first response,
+// and waits for the release before writing the second one.
+func flushTestServer(t *testing.T, server *Server, flush bool) (release chan struct{}, stop func()) {
+	release = make(chan struct{})
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "first"})
+		if flush {
+			assert.NoError(t, c.Flush())
+		}
+		<-release
+		c.Write(&pb.Ping{Message: "second"})
+	})
+
+	server.Addr = "127.0.0.1:9011"
+	server.Handler = router
+	server.Codec = &ProtobufCodec{}
+	go server.ListenAndServe()
+	time.Sleep(time.Millisecond * 5)
+	return release, func() { server.Close() }
+}
+
+// dialPing sends a ping to the server, and returns the reader of the responses.
+func dialPing(t *testing.T) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", "127.0.0.1:9011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+	WriteFrame(conn, &pb.Ping{Message: "ping"}, &ProtobufCodec{})
+	return conn, bufio.NewReader(conn)
+}
+
+// readPong reads the next response within the timeout, and returns its
+// message. It returns an empty string, if nothing is read.
+func readPong(t *testing.T, conn net.Conn, r *bufio.Reader, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		fh, err := ReadFrameHeader(r)
+		if err != nil {
+			return ""
+		}
+		if fh.Type != FrameData {
+			readFramePayload(r, fh)
+			continue
+		}
+		req, err := ReadFrameBody(r, fh, &ProtobufCodec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg pb.Ping
+		assert.NoError(t, proto.Unmarshal(req.Data.([]byte), &msg))
+		return msg.Message
+	}
+}
+
+func TestContextFlush(t *testing.T) {
+	for _, n := range []int{0, 4} {
+		release, stop := flushTestServer(t, &Server{MaxConcurrentRequests: n}, true)
+		conn, r := dialPing(t)
+
+		// the first response is flushed by the handler
+		assert.Equal(t, "first", readPong(t, conn, r, time.Second))
+		close(release)
+		assert.Equal(t, "second", readPong(t, conn, r, time.Second))
+
+		conn.Close()
+		stop()
+	}
+}
+
+func TestFlushPerMessage(t *testing.T) {
+	for _, n := range []int{0, 4} {
+		release, stop := flushTestServer(t, &Server{MaxConcurrentRequests: n, FlushPolicy: FlushPerMessage}, false)
+		conn, r := dialPing(t)
+
+		assert.Equal(t, "first", readPong(t, conn, r, time.Second))
+		close(release)
+		assert.Equal(t, "second", readPong(t, conn, r, time.Second))
+
+		conn.Close()
+		stop()
+	}
+}
+
+func TestFlushPerRequest(t *testing.T) {
+	release, stop := flushTestServer(t, &Server{}, false)
+	defer stop()
+	conn, r := dialPing(t)
+	defer conn.Close()
+
+	// nothing is flushed, until the handler returns
+	assert.Equal(t, "", readPong(t, conn, r, time.Millisecond*50))
+	close(release)
+	assert.Equal(t, "first", readPong(t, conn, r, time.Second))
+	assert.Equal(t, "second", readPong(t, conn, r, time.Second))
+}
+
+func TestFlushCoalesce(t *testing.T) {
+	for _, n := range []int{0, 4} {
+		server := &Server{
+			MaxConcurrentRequests: n,
+			FlushPolicy:           FlushCoalesce,
+			FlushDelay:            time.Millisecond * 200,
+		}
+		release, stop := flushTestServer(t, server, false)
+		close(release)
+		conn, r := dialPing(t)
+
+		// the responses are delayed, waiting for the following ones
+		assert.Equal(t, "", readPong(t, conn, r, time.Millisecond*50))
+		assert.Equal(t, "first", readPong(t, conn, r, time.Second))
+		assert.Equal(t, "second", readPong(t, conn, r, time.Second))
+
+		conn.Close()
+		stop()
+	}
+
+	// the responses are flushed, once FlushSize bytes are buffered
+	server := &Server{FlushPolicy: FlushCoalesce, FlushDelay: time.Hour, FlushSize: 1}
+	release, stop := flushTestServer(t, server, false)
+	defer stop()
+	close(release)
+	conn, r := dialPing(t)
+	defer conn.Close()
+	assert.Equal(t, "first", readPong(t, conn, r, time.Second))
+	assert.Equal(t, "second", readPong(t, conn, r, time.Second))
+}
+
+func TestFlushCoalesceSlowRequest(t *testing.T) {
+	for _, n := range []int{0, 4} {
+		release := make(chan struct{})
+		router := New()
+		router.Handle("pb.Ping", func(c *Context) {
+			if readPingMessage(*c.Request) == "slow" {
+				<-release
+			}
+			c.Write(&pb.Ping{Message: "pong"})
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &Server{
+			Handler:               router,
+			Codec:                 &ProtobufCodec{},
+			MaxConcurrentRequests: n,
+			FlushPolicy:           FlushCoalesce,
+			FlushDelay:            time.Millisecond * 20,
+		}
+		go server.Serve(ln)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangePreface(t, conn)
+		WriteFrame(conn, &pb.Ping{Message: "fast"}, &ProtobufCodec{})
+		WriteFrame(conn, &pb.Ping{Message: "slow"}, &ProtobufCodec{})
+		r := bufio.NewReader(conn)
+
+		// the response coalesced is flushed by FlushDelay,
+		// while the following request is still running
+		assert.Equal(t, "pong", readPong(t, conn, r, time.Millisecond*500))
+		close(release)
+		assert.Equal(t, "pong", readPong(t, conn, r, time.Second))
+
+		conn.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,470 @@
+package gotham
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// A Framer reads and writes the frames within the size limits of a
+// connection. The zero value uses DefaultMaxFrameSize and DefaultMaxMessageSize
+// for both reading and writing. A Framer is safe for concurrent use, as long
+// as its fields are not modified.
+//
+// The messages larger than a frame are split into a DATA frame followed by
+// the CONTINUATION frames, all but the last of them are flagged with
+// FlagDataContinued. The frames of a message are never interleaved with
+// any other frame.
+type Framer struct {
+	// MaxReadFrameSize is the maximum payload size of the frames read,
+	// the larger frames are reported as *FrameTooLargeError.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxReadFrameSize uint32
+
+	// MaxWriteFrameSize is the maximum payload size of the frames written.
+	// The larger messages are split into the continuation frames, and the
+	// larger control frames are not written, but reported as *FrameTooLargeError.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxWriteFrameSize uint32
+
+	// MaxReadMessageSize is the maximum size of a message read, which is
+	// the total payload size of its frames. The larger messages are
+	// discarded, and reported as ErrMessageTooLarge.
+	// If zero, DefaultMaxMessageSize is used.
+	MaxReadMessageSize uint32
+
+	// MaxWriteMessageSize is the maximum size of a message written,
+	// the larger messages are not written, and reported as ErrMessageTooLarge.
+	// If zero, DefaultMaxMessageSize is used.
+	MaxWriteMessageSize uint32
+
+	// Compressor compresses the messages written, which are not smaller
+	// than CompressThreshold, and decompresses the messages read.
+	// If nil, the messages are never compressed, and the compressed
+	// messages read are reported as ErrCompression.
+	Compressor Compressor
+
+	// CompressThreshold is the size of the smallest message compressed.
+	// If zero, DefaultCompressThreshold is used.
+	CompressThreshold int
+
+	// Checksum adds the checksum trailer to the frames written, see
+	// FlagFrameChecksum. The checksums of the frames read are always
+	// verified, if they have one.
+	Checksum bool
+
+	// tracer logs the frames read and written, if any.
+	tracer *frameTracer
+}
+
+// defaultFramer is used by the package level helpers.
+var defaultFramer = &Framer{}
+
+// DefaultMaxMessageSize is the maximum message size read and written,
+// when the limits are not set on the Server or the Dialer.
+const DefaultMaxMessageSize = 1 << 20
+
+// ErrMessageTooLarge is returned when a message, which is split into
+// the continuation frames, exceeds the size limit.
+var ErrMessageTooLarge = errors.New("tcp: message too large")
+
+// ErrChecksum is returned when the checksum of a frame does not match
+// its payload, the framing of the connection is still intact.
+var ErrChecksum = errors.New("tcp: frame checksum mismatch")
+
+// isMessageError reports whether the message is discarded for the error,
+// and the rest of the frames can still be read.
+func isMessageError(err error) bool {
+	return err == ErrMessageTooLarge || err == ErrChecksum || errors.Is(err, ErrCompression)
+}
+
+// ErrContinuation is returned when the frames of a message are broken,
+// the framing of the connection can not be recovered from it.
+var ErrContinuation = errors.New("tcp: continuation frame expected")
+
+// FrameTooLargeError is returned when a frame exceeds the size limit.
+type FrameTooLargeError struct {
+	// Length is the payload size of the frame.
+	Length uint32
+	// Max is the size limit exceeded.
+	Max uint32
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes exceeds the limit of %d bytes", ErrFrameTooLarge, e.Length, e.Max)
+}
+
+// Is reports whether the target is ErrFrameTooLarge.
+func (e *FrameTooLargeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
+}
+
+func (fr *Framer) maxReadFrameSize() uint32 {
+	return frameSizeLimit(fr.MaxReadFrameSize)
+}
+
+func (fr *Framer) maxWriteFrameSize() uint32 {
+	return frameSizeLimit(fr.MaxWriteFrameSize)
+}
+
+func (fr *Framer) maxReadMessageSize() uint32 {
+	if fr.MaxReadMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return fr.MaxReadMessageSize
+}
+
+func (fr *Framer) maxWriteMessageSize() uint32 {
+	if fr.MaxWriteMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return fr.MaxWriteMessageSize
+}
+
+func (fr *Framer) compressThreshold() int {
+	if fr.CompressThreshold == 0 {
+		return DefaultCompressThreshold
+	}
+	return fr.CompressThreshold
+}
+
+// negotiate returns a copy of the framer, which never writes the frames
+// and the messages larger than the peer is willing to read. The zero
+// settings mean the peer did not announce them.
+// The compressor is used only if the peer uses the same one, and the
+// checksums only if the peer verifies them.
+func (fr *Framer) negotiate(peer connSettings, cp Compressor) *Framer {
+	f := *fr
+	if max := peer.maxFrameSize; max != 0 && max < f.maxWriteFrameSize() {
+		f.MaxWriteFrameSize = max
+	}
+	if max := peer.maxMessageSize; max != 0 {
+		f.MaxWriteMessageSize = max
+	}
+	if id := compressorID(cp); id != 0 && id == peer.compressor {
+		f.Compressor = cp
+	}
+	// the peers without the checksum support can not read the trailers
+	if !peer.checksum {
+		f.Checksum = false
+	}
+	return &f
+}
+
+func frameSizeLimit(v uint32) uint32 {
+	if v == 0 {
+		return DefaultMaxFrameSize
+	}
+	if v > maxFrameSize {
+		return maxFrameSize
+	}
+	return v
+}
+
+// ReadFrameHeader from the io reader. If the frame is larger than
+// MaxReadFrameSize, the header is returned along with the error, so
+// the caller can skip the payload of it.
+func (fr *Framer) ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	pbuf := fhBytes.Get().(*[]byte)
+	defer fhBytes.Put(pbuf)
+
+	buf := *(pbuf)
+	_, err := io.ReadFull(r, buf[:frameHeaderLen])
+
+	if err != nil {
+		return FrameHeader{}, err
+	}
+
+	fh := FrameHeader{
+		Length: (uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2])),
+		Type:   FrameType(buf[3]),
+		Flags:  Flags(buf[4]),
+	}
+
+	if err = fh.validate(); err != nil {
+		return fh, err
+	}
+
+	if fh.Flags.Has(FlagFrameStream) {
+		if _, err = io.ReadFull(r, buf[:streamIDLen]); err != nil {
+			return fh, err
+		}
+		fh.StreamID = binary.BigEndian.Uint32(buf[:streamIDLen])
+	}
+
+	// frame body size check
+	if max := fr.maxReadFrameSize(); fh.Length > max {
+		return fh, &FrameTooLargeError{Length: fh.Length, Max: max}
+	}
+	return fh, nil
+}
+
+// ReadFrameBody from the io reader and frame header
+// it will return a request if succeed.
+// The message continued by the CONTINUATION frames is reassembled, before
+// it is decoded. If the message is larger than MaxReadMessageSize, all of
+// its frames are discarded, and ErrMessageTooLarge is returned.
+func (fr *Framer) ReadFrameBody(r io.Reader, fh FrameHeader, codec Codec) (req *Request, err error) {
+	// the buffer is never returned to the pool, since
+	// the request may be retained by the caller
+	buf, err := fr.readMessage(r, fh)
+	if err != nil {
+		return nil, err
+	}
+
+	req = &Request{StreamID: fh.StreamID}
+	err = codec.Unmarshal(*buf, req)
+
+	if err != nil {
+		return nil, &CodecError{Err: err}
+	}
+
+	return
+}
+
+// readMessage reads the payload of the data frame, and the payloads of
+// the CONTINUATION frames following it. The message is decompressed,
+// if it is flagged with FlagDataCompressed.
+//
+// The message is read into a pooled buffer, which is owned by the caller,
+// it may be returned to the pool by putBuffer, after it is never used.
+func (fr *Framer) readMessage(r io.Reader, fh FrameHeader) (*[]byte, error) {
+	first := fh
+	compressed := fh.Flags.Has(FlagDataCompressed)
+	max := fr.maxReadMessageSize()
+
+	var buf *[]byte
+	// merr discards the message, but its frames are still read,
+	// so the framing is intact
+	var merr error
+	for {
+		var n int
+		if buf != nil {
+			n = len(*buf)
+		}
+		if merr == nil && uint32(n)+fh.Length > max {
+			merr = ErrMessageTooLarge
+		}
+
+		if merr != nil {
+			putBuffer(buf)
+			buf = nil
+			if err := skipFramePayload(r, fh); err != nil {
+				return nil, err
+			}
+		} else {
+			buf = growBuffer(buf, n+int(fh.Length))
+			if err := readPayload(r, fh, (*buf)[n:]); err == ErrChecksum {
+				merr = err
+			} else if err != nil {
+				putBuffer(buf)
+				return nil, err
+			}
+		}
+
+		if !fh.Flags.Has(FlagDataContinued) {
+			break
+		}
+
+		next, err := fr.ReadFrameHeader(r)
+		if err != nil && !errors.Is(err, ErrFrameTooLarge) {
+			putBuffer(buf)
+			return nil, err
+		}
+		if next.Type != FrameContinuation || next.StreamID != fh.StreamID {
+			putBuffer(buf)
+			return nil, ErrContinuation
+		}
+		if err != nil && merr == nil {
+			merr = ErrMessageTooLarge
+		}
+		fh = next
+	}
+
+	if merr != nil {
+		putBuffer(buf)
+		return nil, merr
+	}
+	if compressed {
+		fb, err := fr.decompress(*buf)
+		putBuffer(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = &fb
+	}
+	fr.tracer.trace(TraceReads, first, *buf)
+	return buf, nil
+}
+
+// decompress the message, the decompressed message is limited
+// by MaxReadMessageSize as well.
+func (fr *Framer) decompress(data []byte) ([]byte, error) {
+	if fr.Compressor == nil {
+		return nil, ErrCompression
+	}
+	zr, err := fr.Compressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCompression, err)
+	}
+	if c, ok := zr.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	max := fr.maxReadMessageSize()
+	fb, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCompression, err)
+	}
+	if uint32(len(fb)) > max {
+		return nil, ErrMessageTooLarge
+	}
+	return fb, nil
+}
+
+// compress the message, it returns the message itself, if the
+// compressed one is not smaller.
+func (fr *Framer) compress(data []byte) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	zw, err := fr.Compressor.NewWriter(&buf)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = zw.Write(data); err != nil {
+		zw.Close()
+		return nil, false, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// ReadFrame reads the next frame, and decodes it with the codec.
+func (fr *Framer) ReadFrame(r io.Reader, codec Codec) (*Request, error) {
+	fh, err := fr.ReadFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return fr.ReadFrameBody(r, fh, codec)
+}
+
+// WriteFrame encodes the data with the codec, and writes it as a frame.
+func (fr *Framer) WriteFrame(w io.Writer, data interface{}, codec Codec) error {
+	// marshal the payload pb
+	buf, err := codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return fr.WriteData(w, buf)
+}
+
+// WriteData with the payload.
+func (fr *Framer) WriteData(w io.Writer, data []byte) error {
+	return fr.writeData(w, 0, data)
+}
+
+func (fr *Framer) writeData(w io.Writer, streamID uint32, data []byte) error {
+	return fr.writeFrame(w, FrameHeader{Type: FrameData, StreamID: streamID}, data)
+}
+
+// writeFrame checks the size of the payload, nothing is written if it
+// exceeds the limits. The data frame larger than MaxWriteFrameSize is
+// split into the continuation frames, after it is compressed.
+func (fr *Framer) writeFrame(w io.Writer, fh FrameHeader, data []byte) error {
+	if fr.Checksum {
+		fh.Flags |= FlagFrameChecksum
+	}
+	fr.tracer.trace(TraceWrites, fh, data)
+
+	if fh.Type == FrameData {
+		if uint32(len(data)) > fr.maxWriteMessageSize() {
+			return ErrMessageTooLarge
+		}
+
+		if fr.Compressor != nil && len(data) >= fr.compressThreshold() {
+			cdata, ok, err := fr.compress(data)
+			if err != nil {
+				return err
+			}
+			if ok {
+				data = cdata
+				fh.Flags |= FlagDataCompressed
+			}
+		}
+	}
+
+	max := fr.maxWriteFrameSize()
+	if uint32(len(data)) <= max {
+		return writeFrame(w, fh, data)
+	}
+	if fh.Type != FrameData {
+		return &FrameTooLargeError{Length: uint32(len(data)), Max: max}
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if uint32(n) > max {
+			n = int(max)
+			fh.Flags |= FlagDataContinued
+		} else {
+			fh.Flags &^= FlagDataContinued
+		}
+		if err := writeFrame(w, fh, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		// only the DATA frame is flagged as compressed
+		fh.Type = FrameContinuation
+		fh.Flags &^= FlagDataCompressed
+	}
+	return nil
+}
+
+// skipFramePayload discards the payload of the frame,
+// which is rejected for its size.
+func skipFramePayload(r io.Reader, fh FrameHeader) error {
+	n := int64(fh.Length)
+	if fh.Flags.Has(FlagFrameChecksum) {
+		n += checksumLen
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// checksumLen is the length of the checksum trailer,
+// which follows the payload, if FlagFrameChecksum is set.
+const checksumLen = 4
+
+// crcTable is used for the checksums of the frames, which are CRC-32C.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// readPayload reads the payload of the frame into buf,
+// and verifies the checksum of it, if any.
+func readPayload(r io.Reader, fh FrameHeader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if !fh.Flags.Has(FlagFrameChecksum) {
+		return nil
+	}
+
+	var sum [checksumLen]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.Checksum(buf, crcTable) {
+		return ErrChecksum
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFramer(t *testing.T) {
+	fr := &Framer{MaxReadFrameSize: 8, MaxWriteFrameSize: 4}
+	var buf bytes.Buffer
+
+	// nothing is written, if the control frame is too large
+	err := fr.writeFrame(&buf, FrameHeader{Type: FramePing}, []byte("12345"))
+	assert.True(t, errors.Is(err, ErrFrameTooLarge))
+	assert.Equal(t, &FrameTooLargeError{Length: 5, Max: 4}, err)
+	assert.Equal(t, 0, buf.Len())
+
+	assert.NoError(t, fr.WriteData(&buf, []byte("1234")))
+	assert.NoError(t, writeData(&buf, 3, []byte("123456789")))
+	assert.NoError(t, fr.WriteData(&buf, []byte("1234")))
+
+	fh, err := fr.ReadFrameHeader(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), fh.Length)
+	readFramePayload(&buf, fh)
+
+	// the header of the oversize frame is returned, so it can be skipped
+	fh, err = fr.ReadFrameHeader(&buf)
+	assert.Equal(t, &FrameTooLargeError{Length: 9, Max: 8}, err)
+	assert.Equal(t, uint32(3), fh.StreamID)
+	assert.NoError(t, skipFramePayload(&buf, fh))
+
+	fh, err = fr.ReadFrameHeader(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), fh.Length)
+
+	// the limits default to DefaultMaxFrameSize, and never exceed the header
+	assert.Equal(t, uint32(DefaultMaxFrameSize), (&Framer{}).maxReadFrameSize())
+	assert.Equal(t, uint32(maxFrameSize), (&Framer{MaxWriteFrameSize: 1 << 30}).maxWriteFrameSize())
+	assert.Equal(t, uint32(1024), (&Framer{}).negotiate(connSettings{maxFrameSize: 1024}, nil).maxWriteFrameSize())
+	assert.Equal(t, uint32(DefaultMaxFrameSize), (&Framer{}).negotiate(connSettings{}, nil).maxWriteFrameSize())
+}
+
+func TestFramerContinuation(t *testing.T) {
+	fr := &Framer{MaxWriteFrameSize: 4}
+	var buf bytes.Buffer
+
+	// the message is split into the continuation frames
+	msg := []byte("0123456789")
+	assert.NoError(t, fr.writeData(&buf, 5, msg))
+	raw := append([]byte(nil), buf.Bytes()...)
+
+	for _, want := range []FrameHeader{
+		{Type: FrameData, Flags: FlagDataContinued, Length: 4},
+		{Type: FrameContinuation, Flags: FlagDataContinued, Length: 4},
+		{Type: FrameContinuation, Length: 2},
+	} {
+		fh, err := ReadFrameHeader(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, want.Type, fh.Type)
+		assert.Equal(t, want.Flags.Has(FlagDataContinued), fh.Flags.Has(FlagDataContinued))
+		assert.Equal(t, want.Length, fh.Length)
+		assert.Equal(t, uint32(5), fh.StreamID)
+		readFramePayload(&buf, fh)
+	}
+
+	// and reassembled by the reader
+	buf.Write(raw)
+	fh, _ := ReadFrameHeader(&buf)
+	payload, err := defaultFramer.readMessage(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, *payload)
+
+	// all the frames of the oversize message are discarded
+	buf.Write(raw)
+	WriteData(&buf, []byte("next"))
+	small := &Framer{MaxReadMessageSize: 8}
+	fh, _ = small.ReadFrameHeader(&buf)
+	_, err = small.readMessage(&buf, fh)
+	assert.Equal(t, ErrMessageTooLarge, err)
+	fh, _ = small.ReadFrameHeader(&buf)
+	payload, err = small.readMessage(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("next"), *payload)
+
+	// nothing is written, if the message is too large
+	buf.Reset()
+	err = (&Framer{MaxWriteFrameSize: 4, MaxWriteMessageSize: 8}).WriteData(&buf, msg)
+	assert.Equal(t, ErrMessageTooLarge, err)
+	assert.Equal(t, 0, buf.Len())
+
+	// the frames of a message can not be interleaved
+	writeFrame(&buf, FrameHeader{Type: FrameData, Flags: FlagDataContinued}, msg[:4])
+	WriteData(&buf, msg[4:])
+	fh, _ = ReadFrameHeader(&buf)
+	_, err = defaultFramer.readMessage(&buf, fh)
+	assert.Equal(t, ErrContinuation, err)
+}
+
+func TestServerFrameSize(t *testing.T) {
+	addr := "127.0.0.1:9004"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		// the response is larger than 4KB
+		if err := c.Write(&pb.Ping{Message: strings.Repeat("a", 8<<10)}); err != nil {
+			c.Write(&pb.Error{Message: err.Error()})
+		}
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.MaxReadFrameSize = 64
+	server.MaxMessageSize = 1024
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	// the oversize frame and the oversize message are discarded,
+	// without closing the connection
+	WriteFrame(w, &pb.Ping{Message: strings.Repeat("a", 128)}, &ProtobufCodec{})
+	fr := &Framer{MaxWriteFrameSize: 64}
+	fr.WriteFrame(w, &pb.Ping{Message: strings.Repeat("a", 2048)}, &ProtobufCodec{})
+	// the request split into the frames is reassembled
+	fr.WriteFrame(w, &pb.Ping{Message: strings.Repeat("a", 128)}, &ProtobufCodec{})
+	w.Flush()
+
+	res, err := ReadFrame(r, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+
+	// the server never writes larger than the client can read
+	client, err := (&Dialer{Codec: &ProtobufCodec{}, MaxReadFrameSize: 4 << 10}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var resp Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &resp))
+	assert.Equal(t, "pb.Ping", resp.TypeURL)
+	assert.Equal(t, 8<<10, len(readPingMessage(resp)))
+
+	// nor the message larger than the client can read
+	client, err = (&Dialer{Codec: &ProtobufCodec{}, MaxMessageSize: 4 << 10}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &resp))
+	assert.Equal(t, "pb.Error", resp.TypeURL)
+}
+
+func TestClientFrameSize(t *testing.T) {
+	addr := "127.0.0.1:9004"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: strings.Repeat("a", 8<<10)})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.MaxReadFrameSize = 64
+	server.MaxMessageSize = 1024
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// wait for the settings of the server
+	assert.NoError(t, client.UpdateSettings(context.Background()))
+
+	// the message larger than the server's limit is never written,
+	// the client is still usable
+	var res Request
+	err = client.Call(context.Background(), &pb.Ping{Message: strings.Repeat("a", 2048)}, &res)
+	assert.Equal(t, ErrMessageTooLarge, err)
+
+	// the message larger than a frame is split
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: strings.Repeat("a", 128)}, &res))
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+}
+
+func TestFramerChecksum(t *testing.T) {
+	fr := &Framer{Checksum: true, MaxWriteFrameSize: 4}
+	var buf bytes.Buffer
+
+	msg := []byte("0123456789")
+	assert.NoError(t, fr.writeData(&buf, 1, msg))
+	raw := append([]byte(nil), buf.Bytes()...)
+
+	fh, err := ReadFrameHeader(&buf)
+	assert.NoError(t, err)
+	assert.True(t, fh.Flags.Has(FlagFrameChecksum))
+	payload, err := fr.readMessage(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, *payload)
+
+	// the corrupted message is discarded, the next one is still readable
+	raw[frameHeaderLen+streamIDLen+1] ^= 0xff
+	buf.Write(raw)
+	fr.WriteData(&buf, []byte("next"))
+	fh, _ = ReadFrameHeader(&buf)
+	_, err = fr.readMessage(&buf, fh)
+	assert.Equal(t, ErrChecksum, err)
+
+	fh, _ = ReadFrameHeader(&buf)
+	payload, err = fr.readMessage(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("next"), *payload)
+
+	// the trailer is skipped with the payload
+	fr.WriteData(&buf, []byte("skip"))
+	fr.WriteData(&buf, []byte("next"))
+	fh, _ = ReadFrameHeader(&buf)
+	assert.NoError(t, skipFramePayload(&buf, fh))
+	fh, _ = ReadFrameHeader(&buf)
+	next, err := readFramePayload(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("next"), next)
+
+	// the checksums are written only, if the peer verifies them
+	assert.False(t, fr.negotiate(connSettings{}, nil).Checksum)
+	assert.True(t, fr.negotiate(connSettings{checksum: true}, nil).Checksum)
+}
+
+func TestServerChecksum(t *testing.T) {
+	addr := "127.0.0.1:9004"
+	var failures int32
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	server.Checksum = true
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.OnChecksumError = func(_ net.Conn, fh FrameHeader) {
+		assert.Equal(t, FrameData, fh.Type)
+		atomic.AddInt32(&failures, 1)
+	}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	writeFrame(w, FrameHeader{Type: FrameSettings}, encodeSettings([]Setting{
+		{ID: SettingChecksum, Val: 1},
+	}))
+	w.Flush()
+	fh, _ := ReadFrameHeader(r)
+	readFramePayload(r, fh)
+
+	// the corrupted request is discarded, without closing the connection
+	fr := &Framer{Checksum: true}
+	var buf bytes.Buffer
+	fr.WriteFrame(&buf, &pb.Ping{Message: "Corrupted"}, &ProtobufCodec{})
+	raw := buf.Bytes()
+	raw[len(raw)-checksumLen-1] ^= 0xff
+	w.Write(raw)
+	fr.WriteFrame(w, &pb.Ping{Message: "Ping"}, &ProtobufCodec{})
+	w.Flush()
+
+	// the response carries the checksum
+	fh, err = ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.True(t, fh.Flags.Has(FlagFrameChecksum))
+	res, err := fr.ReadFrameBody(r, fh, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failures))
+}
+
+// readFramePayload reads the frame body as raw bytes.
+func readFramePayload(r io.Reader, fh FrameHeader) ([]byte, error) {
+	fb := make([]byte, fh.Length)
+	if err := readPayload(r, fh, fb); err != nil {
+		return nil, err
+	}
+	return fb, nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/stretchr/testify v1.4.0
 	github.com/xtaci/kcp-go v5.4.20+incompatible
 	golang.org/x/crypto v0.0.0-20220507011949-2cf3adece122
+	google.golang.org/protobuf v1.28.0
 )
 
 require (
@@ -23,6 +24,5 @@ require (
 	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,197 @@
+package gotham
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrGoAway is returned by the Client, after the server sent the GOAWAY
+// frame. The errors returned are of type *GoAwayError, which matches
+// ErrGoAway with errors.Is.
+var ErrGoAway = errors.New("tcp: server going away")
+
+// An ErrCode is the reason carried by the GOAWAY frame.
+type ErrCode uint32
+
+const (
+	// ErrCodeNo is the graceful shutdown of the server.
+	ErrCodeNo ErrCode = 0x0
+	// ErrCodeProtocol is a protocol error of the peer.
+	ErrCodeProtocol ErrCode = 0x1
+	// ErrCodeInternal is an internal error of the server.
+	ErrCodeInternal ErrCode = 0x2
+	// ErrCodeFrameSize is a frame or a message of the peer, which
+	// exceeds the size limits, or a control frame of invalid size.
+	ErrCodeFrameSize ErrCode = 0x3
+	// ErrCodeCodec is a message the codec can not decode.
+	ErrCodeCodec ErrCode = 0x4
+	// ErrCodeTimeout is a timeout of reading or writing the connection.
+	ErrCodeTimeout ErrCode = 0x5
+	// ErrCodeAuth is a connection not authenticated, see Router.Auth.
+	ErrCodeAuth ErrCode = 0x6
+	// ErrCodeRefused is a connection rejected at accept time,
+	// see Server.MaxConns and Server.MaxConnsPerIP.
+	ErrCodeRefused ErrCode = 0x7
+)
+
+var errCodeName = map[ErrCode]string{
+	ErrCodeNo:        "NO_ERROR",
+	ErrCodeProtocol:  "PROTOCOL_ERROR",
+	ErrCodeInternal:  "INTERNAL_ERROR",
+	ErrCodeFrameSize: "FRAME_SIZE_ERROR",
+	ErrCodeCodec:     "CODEC_ERROR",
+	ErrCodeTimeout:   "TIMEOUT",
+	ErrCodeAuth:      "AUTH_ERROR",
+	ErrCodeRefused:   "REFUSED",
+}
+
+func (e ErrCode) String() string {
+	if s, ok := errCodeName[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("UNKNOWN_ERR_CODE_%d", uint32(e))
+}
+
+// goAwayPayloadLen is the length of the GOAWAY frame payload, 4 bytes
+// of the last stream id followed by 4 bytes of the error code.
+const goAwayPayloadLen = 8
+
+// GoAwayError is returned by the Client, after the server sent the GOAWAY
+// frame. The calls with the stream ids greater than LastStreamID were never
+// handled by the server, so they can be retried on another connection.
+type GoAwayError struct {
+	// LastStreamID is the stream id of the last request read by the server.
+	LastStreamID uint32
+	// Code is the reason of the GOAWAY.
+	Code ErrCode
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("%v: last stream %d, code %v", ErrGoAway, e.LastStreamID, e.Code)
+}
+
+// Is reports whether the target is ErrGoAway.
+func (e *GoAwayError) Is(target error) bool {
+	return target == ErrGoAway
+}
+
+// goAwayTimeout limits the time of writing the GOAWAY frame, if the
+// Server's WriteTimeout is not set, so the peer not reading never
+// holds the Shutdown.
+const goAwayTimeout = time.Second
+
+func encodeGoAway(lastStreamID uint32, code ErrCode) []byte {
+	payload := make([]byte, goAwayPayloadLen)
+	binary.BigEndian.PutUint32(payload, lastStreamID)
+	binary.BigEndian.PutUint32(payload[4:], uint32(code))
+	return payload
+}
+
+// goAway sends the GOAWAY frame with the code, and the stream id of the
+// last request read. It is sent once at most, after the preface. If the
+// preface is not written yet, the frame is sent by servePreface after it.
+func (c *conn) goAway(code ErrCode) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	// the client reads the preface before any frame
+	if c.version == 0 {
+		c.goAwayCode, c.goAwayPending = code, true
+		return nil
+	}
+	return c.goAwayLocked(code)
+}
+
+// goAwayLocked writes the GOAWAY frame, wmu must be held.
+func (c *conn) goAwayLocked(code ErrCode) error {
+	c.streamMu.Lock()
+	if c.goAwaySent {
+		c.streamMu.Unlock()
+		return nil
+	}
+	c.goAwaySent = true
+	lastStreamID := c.lastStreamID
+	c.streamMu.Unlock()
+
+	if c.server.WriteTimeout == 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(goAwayTimeout))
+		defer c.rwc.SetWriteDeadline(time.Time{})
+	}
+	payload := encodeGoAway(lastStreamID, code)
+	return c.writeControlFrameLocked(FrameHeader{Type: FrameGoAway}, payload)
+}
+
+// acceptStream records the stream id of the request read. It reports false,
+// if the stream id is above the one sent by the GOAWAY frame.
+func (c *conn) acceptStream(streamID uint32) bool {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	if streamID <= c.lastStreamID {
+		return true
+	}
+	if c.goAwaySent {
+		return false
+	}
+	c.lastStreamID = streamID
+	return true
+}
+
+// goAway sends the GOAWAY frame to all the connections,
+// and waits for the frames to be written.
+func (srv *Server) goAway(code ErrCode) {
+	srv.mu.Lock()
+	conns := make([]*conn, 0, len(srv.activeConn))
+	for c := range srv.activeConn {
+		conns = append(conns, c)
+	}
+	srv.mu.Unlock()
+
+	// the connections handling the requests are waited concurrently
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *conn) {
+			defer wg.Done()
+			// the connections closed meanwhile are not errors
+			if err := c.goAway(code); err != nil && !errors.Is(err, net.ErrClosed) {
+				srv.logf("tcp: GOAWAY error to %v: %v", c.remoteAddr, err)
+				// the writer is broken, nothing is written to the conn anymore
+				c.rwc.Close()
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// processGoAway stops the new calls, and fails the pending ones,
+// which were never handled by the server.
+func (c *Client) processGoAway(payload []byte) error {
+	if len(payload) != goAwayPayloadLen {
+		return ErrFrameSize
+	}
+	ga := &GoAwayError{
+		LastStreamID: binary.BigEndian.Uint32(payload),
+		Code:         ErrCode(binary.BigEndian.Uint32(payload[4:])),
+	}
+
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ga
+	}
+	for id, ch := range c.pending {
+		if id > ga.LastStreamID {
+			delete(c.pending, id)
+			ch <- callResult{err: ga}
+		}
+	}
+	c.mu.Unlock()
+
+	if hook := c.dialer.OnGoAway; hook != nil {
+		hook(c, ga)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoAway(t *testing.T) {
+	assert.Equal(t, "NO_ERROR", ErrCodeNo.String())
+	assert.Equal(t, "UNKNOWN_ERR_CODE_255", ErrCode(0xff).String())
+
+	var err error = &GoAwayError{LastStreamID: 3, Code: ErrCodeNo}
+	assert.True(t, errors.Is(err, ErrGoAway))
+	assert.Equal(t, "tcp: server going away: last stream 3, code NO_ERROR", err.Error())
+}
+
+func TestServerGoAway(t *testing.T) {
+	addr := "127.0.0.1:9008"
+
+	for _, concurrent := range []int{0, 4} {
+		started, release := make(chan struct{}), make(chan struct{})
+		router := New()
+		router.Handle("pb.Ping", func(c *Context) {
+			if readPingMessage(*c.Request) == "Slow" {
+				close(started)
+				<-release
+			}
+			c.Write(&pb.Ping{Message: "Pong"})
+		})
+		server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+		server.MaxConcurrentRequests = concurrent
+		go server.ListenAndServe()
+
+		time.Sleep(time.Millisecond * 5)
+
+		goAways := make(chan *GoAwayError, 1)
+		client, err := (&Dialer{
+			Codec:    &ProtobufCodec{},
+			OnGoAway: func(_ *Client, ga *GoAwayError) { goAways <- ga },
+		}).Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var res Request
+		assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+
+		// the request being handled is not interrupted by the shutdown
+		slow := make(chan error, 1)
+		go func() {
+			var res Request
+			slow <- client.Call(context.Background(), &pb.Ping{Message: "Slow"}, &res)
+		}()
+		<-started
+
+		shutdown := make(chan struct{})
+		go func() {
+			server.Shutdown()
+			close(shutdown)
+		}()
+
+		// the GOAWAY frame is sent, while the request is being handled
+		ga := <-goAways
+		assert.Equal(t, uint32(2), ga.LastStreamID)
+		assert.Equal(t, ErrCodeNo, ga.Code)
+		close(release)
+		assert.NoError(t, <-slow)
+
+		// the new calls are not started on the connection
+		err = client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res)
+		assert.True(t, errors.Is(err, ErrGoAway))
+
+		select {
+		case <-shutdown:
+		case <-time.After(time.Second * 2):
+			t.Fatal("shutdown timeout")
+		}
+		client.Close()
+	}
+}
+
+func TestServerGoAwayDropsStreams(t *testing.T) {
+	for _, concurrent := range []int{0, 4} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var handled int32
+		router := New()
+		router.Handle("pb.Ping", func(c *Context) {
+			atomic.AddInt32(&handled, 1)
+			c.Write(&pb.Ping{Message: "Pong"})
+		})
+		server := &Server{Handler: router, Codec: &ProtobufCodec{}}
+		server.MaxConcurrentRequests = concurrent
+		go server.Serve(ln)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangePreface(t, conn)
+
+		w := newBufioWriter(conn)
+		r := newBufioReader(conn)
+
+		payload, _ := (&ProtobufCodec{}).Marshal(&pb.Ping{Message: "Ping"})
+		writeData(w, 1, payload)
+		w.Flush()
+		res, err := ReadFrame(r, &ProtobufCodec{})
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), res.StreamID)
+
+		server.goAway(ErrCodeNo)
+		fh, err := ReadFrameHeader(r)
+		assert.NoError(t, err)
+		assert.Equal(t, FrameGoAway, fh.Type)
+		body, _ := readFramePayload(r, fh)
+		assert.Equal(t, uint32(1), binary.BigEndian.Uint32(body))
+
+		// the call sent after the GOAWAY frame is dropped,
+		// the ones within the last stream id are still handled
+		writeData(w, 3, payload)
+		writeData(w, 1, payload)
+		w.Flush()
+		res, err = ReadFrame(r, &ProtobufCodec{})
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), res.StreamID)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestServerGoAwayBeforePreface(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Handler: New(), Codec: &ProtobufCodec{}}
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return len(server.Conns()) == 1
+	}, time.Second, time.Millisecond)
+
+	// the GOAWAY frame is sent right after the preface,
+	// which the client had not written yet
+	server.goAway(ErrCodeNo)
+	client := (&Dialer{Codec: &ProtobufCodec{}}).NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res Request
+	err = client.Call(ctx, &pb.Ping{Message: "Ping"}, &res)
+	var ga *GoAwayError
+	assert.True(t, errors.As(err, &ga), "error: %v", err)
+	if ga != nil {
+		assert.Equal(t, uint32(0), ga.LastStreamID)
+	}
+}
+
+func TestServerGoAwayClosedConn(t *testing.T) {
+	var buf bytes.Buffer
+	server := &Server{ErrorLog: log.New(&buf, "", 0)}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	// the bufw of the connection closed is returned to the pool
+	c := &conn{server: server, rwc: c1, remoteAddr: "pipe", version: ProtocolVersion}
+	server.trackConn(c, true)
+	c1.Close()
+
+	assert.True(t, errors.Is(c.goAway(ErrCodeNo), net.ErrClosed))
+
+	// the connections closed during Shutdown are not logged
+	c.goAwaySent = false
+	server.goAway(ErrCodeNo)
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,131 @@
+package gotham
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// pingPayloadLen is the length of the ping frame payload.
+const pingPayloadLen = 8
+
+// processPing answers the ping of the peer, and measures the round-trip
+// time, if the ping is the acknowledgement of the server's ping.
+func (c *conn) processPing(fh FrameHeader, payload []byte) error {
+	if len(payload) != pingPayloadLen {
+		return ErrFrameSize
+	}
+
+	if fh.Flags.Has(FlagPingAck) {
+		sent := int64(binary.BigEndian.Uint64(payload))
+		if sent != 0 && atomic.CompareAndSwapInt64(&c.pingSent, sent, 0) {
+			atomic.StoreInt64(&c.rtt, time.Now().UnixNano()-sent)
+		}
+		return nil
+	}
+
+	if err := c.writeControlFrame(FrameHeader{Type: FramePing, Flags: FlagPingAck}, payload); err != nil {
+		return err
+	}
+
+	// the peer understands the ping, so ping it back to measure the rtt
+	now := time.Now().UnixNano()
+	if atomic.CompareAndSwapInt64(&c.pingSent, 0, now) {
+		var data [pingPayloadLen]byte
+		binary.BigEndian.PutUint64(data[:], uint64(now))
+		return c.writeControlFrame(FrameHeader{Type: FramePing}, data[:])
+	}
+	return nil
+}
+
+// writeControlFrame writes the frame, and flushes it immediately.
+// It is safe to be called by any goroutine.
+func (c *conn) writeControlFrame(fh FrameHeader, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeControlFrameLocked(fh, payload)
+}
+
+func (c *conn) writeControlFrameLocked(fh FrameHeader, payload []byte) error {
+	// the connection is closed, and bufw returned to the pool
+	if c.bufw == nil {
+		return net.ErrClosed
+	}
+
+	if d := c.server.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+	c.tracer.trace(TraceWrites, fh, payload)
+	if err := writeFrame(c.bufw, fh, payload); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// Ping sends a ping to the server, and waits for the acknowledgement of it.
+// It returns the round-trip time of the ping.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return 0, c.err
+	}
+	c.nextPingID++
+	id := c.nextPingID
+	ch := make(chan struct{})
+	c.pings[id] = ch
+	c.mu.Unlock()
+
+	var payload [pingPayloadLen]byte
+	binary.BigEndian.PutUint64(payload[:], id)
+
+	start := time.Now()
+	if err := c.writeFrame(ctx, FrameHeader{Type: FramePing}, payload[:]); err != nil {
+		c.removePing(id)
+		return 0, err
+	}
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		c.removePing(id)
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, c.getErr()
+	}
+}
+
+// processPing answers the ping of the server, or wakes up the
+// caller of Ping, if it is the acknowledgement.
+func (c *Client) processPing(fh FrameHeader, payload []byte) error {
+	if len(payload) != pingPayloadLen {
+		return ErrFrameSize
+	}
+
+	if fh.Flags.Has(FlagPingAck) {
+		id := binary.BigEndian.Uint64(payload)
+		c.mu.Lock()
+		if ch, ok := c.pings[id]; ok {
+			delete(c.pings, id)
+			close(ch)
+		}
+		c.mu.Unlock()
+		return nil
+	}
+
+	// answer the ping in a new goroutine, so the reading is never blocked,
+	// the payload is copied, since it is returned to the pool
+	var ack [pingPayloadLen]byte
+	copy(ack[:], payload)
+	go c.writeFrame(context.Background(), FrameHeader{Type: FramePing, Flags: FlagPingAck}, ack[:])
+	return nil
+}
+
+func (c *Client) removePing(id uint64) {
+	c.mu.Lock()
+	delete(c.pings, id)
+	c.mu.Unlock()
+}
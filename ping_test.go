@@ -0,0 +1,119 @@
+package gotham
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerPing(t *testing.T) {
+	addr := "127.0.0.1:9002"
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	payload := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	writeFrame(w, FrameHeader{Type: FramePing}, payload)
+	w.Flush()
+
+	// the server acknowledges the ping with the same payload
+	fh, err := ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, FramePing, fh.Type)
+	assert.True(t, fh.Flags.Has(FlagPingAck))
+	ack, _ := readFramePayload(r, fh)
+	assert.Equal(t, payload, ack)
+
+	// then pings back to measure the rtt
+	fh, err = ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, FramePing, fh.Type)
+	assert.False(t, fh.Flags.Has(FlagPingAck))
+	ping, _ := readFramePayload(r, fh)
+
+	time.Sleep(time.Millisecond * 5)
+	writeFrame(w, FrameHeader{Type: FramePing, Flags: FlagPingAck}, ping)
+	w.Flush()
+	time.Sleep(time.Millisecond * 5)
+
+	server.mu.Lock()
+	for c := range server.activeConn {
+		rtt := (&Request{conn: c}).RTT()
+		assert.True(t, rtt >= time.Millisecond*5, "rtt: %v", rtt)
+	}
+	server.mu.Unlock()
+
+	// the data frames still work
+	WriteFrame(w, &pb.Ping{Message: "Ping"}, &ProtobufCodec{})
+	w.Flush()
+	res, err := ReadFrame(r, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+
+	// invalid ping closes the connection
+	writeFrame(w, FrameHeader{Type: FramePing}, payload[:4])
+	w.Flush()
+	_, err = ReadFrameHeader(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestClientPing(t *testing.T) {
+	addr := "127.0.0.1:9002"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: c.Request.RTT().String()})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var res Request
+	client.Call(context.Background(), &pb.Ping{}, &res)
+	assert.Equal(t, time.Duration(0).String(), readPingMessage(res))
+
+	rtt, err := client.Ping(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, rtt > 0)
+
+	// the server measures the rtt, by pinging the client back
+	time.Sleep(time.Millisecond * 5)
+	client.Call(context.Background(), &pb.Ping{}, &res)
+	assert.NotEqual(t, time.Duration(0).String(), readPingMessage(res))
+
+	client.Close()
+	_, err = client.Ping(context.Background())
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func readPingMessage(res Request) string {
+	var msg pb.Ping
+	proto.Unmarshal(res.Data.([]byte), &msg)
+	return msg.GetMessage()
+}
@@ -0,0 +1,148 @@
+package gotham
+
+import (
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+)
+
+// The size classes of the pooled buffers, which are the powers of two
+// from 512 bytes up to 16MB. The larger buffers are never pooled.
+const (
+	minBufferClass = 9
+	maxBufferClass = 24
+)
+
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// bufferClass returns the index of the smallest size class,
+// which fits n bytes, or -1 if n is larger than all of them.
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClass {
+		return 0
+	}
+	c := bits.Len(uint(n-1)) - minBufferClass
+	if c >= len(bufferPools) {
+		return -1
+	}
+	return c
+}
+
+// getBuffer returns a buffer of n bytes from the pool of its size class.
+// The buffer should be returned by putBuffer, after it is never used.
+func getBuffer(n int) *[]byte {
+	c := bufferClass(n)
+	if c < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+	if v := bufferPools[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n, 1<<(c+minBufferClass))
+	return &b
+}
+
+// putBuffer returns the buffer to the pool of its size class,
+// the buffers not allocated by getBuffer are dropped.
+func putBuffer(b *[]byte) {
+	if b == nil {
+		return
+	}
+	c := bufferClass(cap(*b))
+	if c < 0 || cap(*b) != 1<<(c+minBufferClass) {
+		return
+	}
+	bufferPools[c].Put(b)
+}
+
+// growBuffer returns a buffer of n bytes, which starts with the content
+// of b. The buffer b is returned to the pool, if it is too small.
+func growBuffer(b *[]byte, n int) *[]byte {
+	if b == nil {
+		return getBuffer(n)
+	}
+	if cap(*b) >= n {
+		*b = (*b)[:n]
+		return b
+	}
+	nb := getBuffer(n)
+	copy(*nb, *b)
+	putBuffer(b)
+	return nb
+}
+
+var requestPool = sync.Pool{
+	New: func() interface{} {
+		return new(Request)
+	},
+}
+
+// getRequest returns an empty Request from the pool.
+func getRequest() *Request {
+	return requestPool.Get().(*Request)
+}
+
+// putRequest returns the request and its buffer to the pools,
+// after the handler of it returned.
+func putRequest(req *Request) {
+	putBuffer(req.buf)
+	*req = Request{}
+	requestPool.Put(req)
+}
+
+var responseWriterPool = sync.Pool{
+	New: func() interface{} {
+		return new(responseWriter)
+	},
+}
+
+// getResponseWriter returns a responseWriter from the pool,
+// which writes the responses of the stream into w.
+func getResponseWriter(w io.Writer, codec Codec, streamID uint32, fr *Framer) *responseWriter {
+	rw := responseWriterPool.Get().(*responseWriter)
+	rw.writer = w
+	rw.keepAlive = true
+	rw.status = defaultStatus
+	rw.codec = codec
+	rw.streamID = streamID
+	rw.framer = fr
+	return rw
+}
+
+// putResponseWriter returns the writer to the pool,
+// after the handler of the request returned.
+func putResponseWriter(rw *responseWriter) {
+	*rw = responseWriter{}
+	responseWriterPool.Put(rw)
+}
+
+// frameBuffers holds the header and the checksum of a frame written,
+// along with the net.Buffers of them and the payload.
+type frameBuffers struct {
+	header [frameHeaderLen + streamIDLen]byte
+	sum    [checksumLen]byte
+	array  [3][]byte
+	bufs   net.Buffers
+}
+
+var frameBuffersPool = sync.Pool{
+	New: func() interface{} {
+		return new(frameBuffers)
+	},
+}
+
+func getFrameBuffers() *frameBuffers {
+	return frameBuffersPool.Get().(*frameBuffers)
+}
+
+// putFrameBuffers returns the buffers to the pool, after the frame
+// is written. The payload is released, so it is not retained.
+func putFrameBuffers(fb *frameBuffers) {
+	fb.array = [3][]byte{}
+	fb.bufs = nil
+	frameBuffersPool.Put(fb)
+}
@@ -0,0 +1,126 @@
+package gotham
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/fbs"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPool(t *testing.T) {
+	assert.Equal(t, 0, bufferClass(0))
+	assert.Equal(t, 0, bufferClass(512))
+	assert.Equal(t, 1, bufferClass(513))
+	assert.Equal(t, 1, bufferClass(1024))
+	assert.Equal(t, maxBufferClass-minBufferClass, bufferClass(1<<maxBufferClass))
+	assert.Equal(t, -1, bufferClass(1<<maxBufferClass+1))
+
+	b := getBuffer(600)
+	assert.Equal(t, 600, len(*b))
+	assert.Equal(t, 1024, cap(*b))
+
+	// the content is kept, while the buffer grows
+	copy(*b, "hello")
+	b = growBuffer(b, 2000)
+	assert.Equal(t, 2000, len(*b))
+	assert.Equal(t, 2048, cap(*b))
+	assert.Equal(t, []byte("hello"), (*b)[:5])
+	b = growBuffer(b, 10)
+	assert.Equal(t, 2048, cap(*b))
+	putBuffer(b)
+
+	// the buffers larger than the classes are not pooled
+	b = getBuffer(1<<maxBufferClass + 1)
+	assert.Equal(t, 1<<maxBufferClass+1, cap(*b))
+	putBuffer(b)
+	putBuffer(nil)
+
+	// neither the ones not allocated by getBuffer
+	odd := make([]byte, 1000)
+	putBuffer(&odd)
+}
+
+func TestRequestPool(t *testing.T) {
+	codec := &ProtobufCodec{}
+	data, _ := codec.Marshal(&pb.Ping{Message: "Ping"})
+	var buf bytes.Buffer
+	defaultFramer.writeData(&buf, 3, data)
+
+	c := (&Server{Codec: codec}).newConn(nil)
+	c.bufr = bufio.NewReader(&buf)
+	fh, err := ReadFrameHeader(c.bufr)
+	assert.NoError(t, err)
+
+	req, err := c.readRequest(fh)
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", req.TypeURL)
+	assert.Equal(t, uint32(3), req.StreamID)
+	assert.NotNil(t, req.buf)
+
+	// the clone is valid after the request is returned to the pool
+	clone := req.Clone()
+	assert.Nil(t, clone.buf)
+	putRequest(req)
+	assert.Equal(t, Request{}, *req)
+
+	var msg pb.Ping
+	assert.NoError(t, proto.Unmarshal(clone.Data.([]byte), &msg))
+	assert.Equal(t, "Ping", msg.Message)
+	assert.Equal(t, "pb.Ping", clone.TypeURL)
+
+	// the Data decoded from the pooled message is decoded again
+	fc := &FlatbuffersCodec{}
+	msgt := &fbs.MessageT{Data: &fbs.AnyT{Type: fbs.AnyPing, Value: &fbs.PingT{Timestamp: 7}}}
+	data, _ = fc.Marshal(msgt)
+	buf.Reset()
+	defaultFramer.writeData(&buf, 5, data)
+	fcc := (&Server{Codec: fc}).newConn(nil)
+	fcc.bufr = bufio.NewReader(&buf)
+	fh, _ = ReadFrameHeader(fcc.bufr)
+	req, err = fcc.readRequest(fh)
+	assert.NoError(t, err)
+	req.conn = fcc
+	clone = req.Clone()
+	assert.True(t, clone.Data != req.Data)
+	putRequest(req)
+	assert.Equal(t, msgt.Data, clone.Data)
+	assert.Equal(t, uint32(5), clone.StreamID)
+
+	// the message can not be decoded
+	buf.Reset()
+	WriteData(&buf, []byte{0xff, 0xff})
+	c.bufr.Reset(&buf)
+	fh, _ = ReadFrameHeader(c.bufr)
+	_, err = c.readRequest(fh)
+	assert.True(t, errors.Is(err, ErrCodec))
+}
+
+func TestProtobufCodecUnmarshal(t *testing.T) {
+	codec := &ProtobufCodec{}
+	data, _ := codec.Marshal(&pb.Ping{Message: "Ping"})
+
+	var req Request
+	assert.NoError(t, codec.Unmarshal(data, &req))
+	assert.Equal(t, "pb.Ping", req.TypeURL)
+	var msg pb.Ping
+	assert.NoError(t, proto.Unmarshal(req.Data.([]byte), &msg))
+	assert.Equal(t, "Ping", msg.Message)
+
+	// the unknown fields are skipped
+	data = append(data, 0x18, 0x01)
+	assert.NoError(t, codec.Unmarshal(data, &req))
+	assert.Equal(t, "pb.Ping", req.TypeURL)
+
+	// the type urls are cached, only the slice header of Data is allocated
+	allocs := testing.AllocsPerRun(100, func() {
+		codec.Unmarshal(data, &req)
+	})
+	assert.Equal(t, float64(1), allocs)
+
+	assert.Error(t, codec.Unmarshal([]byte{0x0a, 0x10}, &req))
+}
@@ -0,0 +1,117 @@
+package gotham
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPreface is returned when the peer does not start the connection
+// with the preface, such as an HTTP client or a port scanner.
+var ErrPreface = errors.New("tcp: bad connection preface")
+
+// ErrVersion is returned by the Client, when the server does not
+// speak any of the protocol versions the client supports.
+var ErrVersion = errors.New("tcp: unsupported protocol version")
+
+const (
+	// ProtocolVersion is the latest version of the protocol,
+	// which is announced by the preface.
+	ProtocolVersion uint8 = 0x1
+	// MinProtocolVersion is the oldest version of the protocol,
+	// the peers with older ones are rejected.
+	MinProtocolVersion uint8 = 0x1
+)
+
+// prefaceMagic starts the preface.
+const prefaceMagic = "\xffGOTHAM"
+
+// prefaceLen is the length of the preface, the magic
+// followed by 1 byte of the protocol version.
+const prefaceLen = len(prefaceMagic) + 1
+
+// WritePreface writes the preface with the protocol version.
+//
+// The client writes the preface with the latest version it supports,
+// before any frame. The server answers it with the version used by the
+// connection, which is the lower of the client's and its own, or zero
+// if the client's version is not supported, then closes the connection.
+func WritePreface(w io.Writer, version uint8) error {
+	var buf [prefaceLen]byte
+	copy(buf[:], prefaceMagic)
+	buf[len(prefaceMagic)] = version
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadPreface reads the preface, and returns the protocol version of it.
+func ReadPreface(r io.Reader) (uint8, error) {
+	var buf [prefaceLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	if string(buf[:len(prefaceMagic)]) != prefaceMagic {
+		return 0, ErrPreface
+	}
+	return buf[len(prefaceMagic)], nil
+}
+
+// negotiateVersion returns the protocol version used with the peer
+// announcing the version, or zero if it is not supported.
+func negotiateVersion(version uint8) uint8 {
+	if version < MinProtocolVersion {
+		return 0
+	}
+	if version > ProtocolVersion {
+		// the newer peer downgrades to ours
+		return ProtocolVersion
+	}
+	return version
+}
+
+// servePreface reads the preface of the client, and answers it
+// with the protocol version used by the connection.
+func (c *conn) servePreface() error {
+	if d := c.server.ReadTimeout; d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+	version, err := ReadPreface(c.bufr)
+	if err != nil {
+		return err
+	}
+
+	// the version is guarded by wmu, so the GOAWAY
+	// frame is never written before the preface
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.version = negotiateVersion(version)
+	if err := WritePreface(c.bufw, c.version); err != nil {
+		return err
+	}
+	if err := c.bufw.Flush(); err != nil {
+		return err
+	}
+	if c.version == 0 {
+		return ErrVersion
+	}
+	// the GOAWAY frame asked for, while the preface was not written yet
+	if c.goAwayPending {
+		return c.goAwayLocked(c.goAwayCode)
+	}
+	return nil
+}
+
+// readPreface reads the answer of the server to the client's preface.
+func (c *Client) readPreface(r io.Reader) error {
+	version, err := ReadPreface(r)
+	if err != nil {
+		return err
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return ErrVersion
+	}
+	atomic.StoreUint32(&c.version, uint32(version))
+	return nil
+}
@@ -0,0 +1,121 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+// exchangePreface exchanges the preface with the server,
+// before any frame is written into the conn.
+func exchangePreface(t *testing.T, conn net.Conn) {
+	assert.NoError(t, WritePreface(conn, ProtocolVersion))
+	version, err := ReadPreface(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+}
+
+func TestPreface(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WritePreface(&buf, ProtocolVersion))
+	assert.Equal(t, prefaceLen, buf.Len())
+	version, err := ReadPreface(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+
+	_, err = ReadPreface(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, ErrPreface, err)
+	_, err = ReadPreface(bytes.NewBufferString("GET"))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	assert.Equal(t, uint8(0), negotiateVersion(MinProtocolVersion-1))
+	assert.Equal(t, ProtocolVersion, negotiateVersion(ProtocolVersion))
+	assert.Equal(t, ProtocolVersion, negotiateVersion(ProtocolVersion+1))
+}
+
+func TestServerPreface(t *testing.T) {
+	addr := "127.0.0.1:9007"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		assert.Equal(t, ProtocolVersion, c.Request.ProtoVersion())
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	// the peer without the preface is disconnected cleanly
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+	conn.Close()
+
+	// the newer peer is downgraded
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WritePreface(conn, ProtocolVersion+1)
+	version, err := ReadPreface(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolVersion, version)
+	conn.Close()
+
+	// the older peer is rejected
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WritePreface(conn, MinProtocolVersion-1)
+	version, err = ReadPreface(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0), version)
+	_, err = ReadPreface(conn)
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, ProtocolVersion, client.ProtoVersion())
+}
+
+func TestClientPreface(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	versionc := make(chan uint8, 1)
+	go func() {
+		version, _ := ReadPreface(c2)
+		versionc <- version
+		// the server does not support the client's version
+		WritePreface(c2, 0)
+		io.Copy(io.Discard, c2)
+	}()
+
+	client := (&Dialer{Codec: &ProtobufCodec{}}).NewClient(c1)
+	defer client.Close()
+	assert.Equal(t, ProtocolVersion, <-versionc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res Request
+	assert.Equal(t, ErrVersion, client.Call(ctx, &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, uint8(0), client.ProtoVersion())
+}
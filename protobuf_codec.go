@@ -2,23 +2,56 @@ package gotham
 
 import (
 	"fmt"
+	"sync"
+
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 type ProtobufCodec struct {
 }
 
+// ID returns the id of the codec announced in the SETTINGS frame.
+func (pc *ProtobufCodec) ID() uint32 {
+	return CodecProtobuf
+}
+
+// Unmarshal decodes the Any message. The Data of the request is the value
+// of it, which references the data without copying it, see Request.
 func (pc *ProtobufCodec) Unmarshal(data []byte, req *Request) error {
-	var msg any.Any
-	err := proto.Unmarshal(data, &msg)
+	var url, value []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
 
-	if err != nil {
-		return err
+		if typ == protowire.BytesType && (num == 1 || num == 2) {
+			b, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if num == 1 {
+				url = b
+			} else {
+				value = b
+			}
+			data = data[n:]
+			continue
+		}
+
+		// skip the unknown fields
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
 	}
 
-	req.Data = msg.GetValue()
-	req.TypeURL = msg.GetTypeUrl()
+	req.Data = value
+	req.TypeURL = typeURL(url)
 	return nil
 }
 
@@ -46,5 +79,33 @@ func (pc *ProtobufCodec) Marshal(data interface{}) ([]byte, error) {
 		return buf, nil
 	}
 
-  return nil, fmt.Errorf("not a prototype message: %v", data)
+	return nil, fmt.Errorf("not a prototype message: %v", data)
+}
+
+// maxTypeURLs limits the type urls cached, the urls are
+// the names of the messages, which are a few usually.
+const maxTypeURLs = 1024
+
+var typeURLs = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// typeURL returns the type url as string, the urls seen
+// are cached, so they are not allocated for every message.
+func typeURL(b []byte) string {
+	typeURLs.RLock()
+	url, ok := typeURLs.m[string(b)]
+	typeURLs.RUnlock()
+	if ok {
+		return url
+	}
+
+	url = string(b)
+	typeURLs.Lock()
+	if len(typeURLs.m) < maxTypeURLs {
+		typeURLs.m[url] = url
+	}
+	typeURLs.Unlock()
+	return url
 }
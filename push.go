@@ -0,0 +1,202 @@
+package gotham
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// ErrConnClosed is returned by Push, when the connection is closed.
+var ErrConnClosed = errors.New("tcp: connection closed")
+
+// ErrPushQueueFull is returned by Push, when the messages pushed are
+// not written as fast as they are queued, see Server.MaxPushQueue.
+// The messages published are dropped for the subscriber then.
+var ErrPushQueueFull = errors.New("tcp: push queue full")
+
+// DefaultMaxPushQueue is the number of the messages queued by Push,
+// if the Server's MaxPushQueue is zero.
+const DefaultMaxPushQueue = 256
+
+// Conn is the handle of a client connection of the Server, which sends
+// the messages to the client outside of its requests. It is obtained by
+// Context.Conn or Request.Conn, and by the Server's Conn with its ID.
+type Conn struct {
+	c *conn
+}
+
+// ID returns the id of the connection, which is unique in the Server.
+func (hc *Conn) ID() uint64 {
+	return hc.c.id
+}
+
+// RemoteAddr returns the remote network address of the connection.
+func (hc *Conn) RemoteAddr() net.Addr {
+	return hc.c.rwc.RemoteAddr()
+}
+
+// Push encodes the message with the Server's codec, and queues it on the
+// writer of the connection. The message is written with the stream id zero,
+// so the clients receive it by Client.Recv. It is safe to be called from
+// any goroutine, including the handlers of the other connections, and it
+// never waits for the message to be written. The messages queued are
+// written by a goroutine of the connection, also while its handlers are
+// running, since the handlers buffer their responses.
+func (hc *Conn) Push(msg interface{}) error {
+	data, err := hc.c.server.Codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return hc.c.push(data)
+}
+
+// Conn returns the handle of the connection the request was read from.
+func (req *Request) Conn() *Conn {
+	if req.conn == nil {
+		return nil
+	}
+	return req.conn.handle
+}
+
+// Conn returns the handle of the connection the request was read from,
+// which may be retained after the handler returns, see Conn.Push.
+func (c *Context) Conn() *Conn {
+	if c.Request == nil {
+		return nil
+	}
+	return c.Request.Conn()
+}
+
+// Conn returns the handle of the live connection with the id.
+func (srv *Server) Conn(id uint64) (*Conn, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	c, ok := srv.connByID[id]
+	if !ok {
+		return nil, false
+	}
+	return c.handle, true
+}
+
+// Conns returns the handles of all the live connections.
+func (srv *Server) Conns() []*Conn {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	conns := make([]*Conn, 0, len(srv.connByID))
+	for _, c := range srv.connByID {
+		conns = append(conns, c.handle)
+	}
+	return conns
+}
+
+func (srv *Server) maxPushQueue() int {
+	if srv.MaxPushQueue > 0 {
+		return srv.MaxPushQueue
+	}
+	return DefaultMaxPushQueue
+}
+
+func (srv *Server) nextConnID() uint64 {
+	return atomic.AddUint64(&srv.lastConnID, 1)
+}
+
+// push queues the message encoded, which is framed by the framer of the
+// connection, when it is written into bufw. The message is never copied,
+// so Publish shares the same one by all the subscribers. The messages are
+// written by a goroutine, which is started if none is running.
+func (c *conn) push(data []byte) error {
+	if uint32(len(data)) > c.getFramer().maxWriteMessageSize() {
+		return ErrMessageTooLarge
+	}
+
+	c.pushMu.Lock()
+	if c.pushClosed {
+		c.pushMu.Unlock()
+		return ErrConnClosed
+	}
+	if len(c.pushes) >= c.server.maxPushQueue() {
+		c.pushMu.Unlock()
+		return ErrPushQueueFull
+	}
+	c.pushes = append(c.pushes, data)
+	start := c.pushReady && !c.pushing
+	if start {
+		c.pushing = true
+	}
+	c.pushMu.Unlock()
+
+	if start {
+		go c.writePushes()
+	}
+	return nil
+}
+
+// startPushes starts writing the messages pushed, after the preface
+// is exchanged, since nothing may be written before it.
+func (c *conn) startPushes() {
+	c.pushMu.Lock()
+	c.pushReady = true
+	start := len(c.pushes) > 0 && !c.pushing
+	if start {
+		c.pushing = true
+	}
+	c.pushMu.Unlock()
+
+	if start {
+		go c.writePushes()
+	}
+}
+
+// closePushes drops the messages queued, and fails the following pushes.
+func (c *conn) closePushes() {
+	c.pushMu.Lock()
+	c.pushClosed = true
+	c.pushes = nil
+	c.pushMu.Unlock()
+}
+
+// writePushes writes the messages queued, until the queue is empty.
+// The frames are flushed by the Server's FlushPolicy, as the responses.
+func (c *conn) writePushes() {
+	for {
+		c.pushMu.Lock()
+		msgs := c.pushes
+		c.pushes = nil
+		if len(msgs) == 0 || c.pushClosed {
+			c.pushing = false
+			c.pushMu.Unlock()
+			return
+		}
+		c.pushMu.Unlock()
+
+		c.wmu.Lock()
+		err := c.writePushesLocked(msgs)
+		c.wmu.Unlock()
+		if err != nil {
+			c.connError("write", err)
+			c.rwc.Close()
+		}
+	}
+}
+
+func (c *conn) writePushesLocked(msgs [][]byte) error {
+	// the connection is closed already
+	if c.bufw == nil {
+		return nil
+	}
+	fr := c.getFramer()
+	for _, data := range msgs {
+		err := fr.writeData(c.bufw, 0, data)
+		// the message exceeding the limits renegotiated since it was
+		// queued is dropped, nothing of it is written
+		if err == ErrMessageTooLarge {
+			c.server.logf("tcp: drop the message pushed to %v: %v", c.remoteAddr, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&c.messagesWritten, 1)
+	}
+	return c.flushResponsesLocked(true)
+}
@@ -0,0 +1,140 @@
+package gotham
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnPush(t *testing.T) {
+	addr := "127.0.0.1:9012"
+	conns := make(chan *Conn, 2)
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		conns <- c.Conn()
+		// push to all the connections, while handling the request
+		if c.Request.Data != nil && len(c.Request.Data.([]byte)) > 0 {
+			for _, hc := range c.Conn().c.server.Conns() {
+				assert.NoError(t, hc.Push(&pb.Ping{Message: "broadcast"}))
+			}
+		}
+		c.Write(&pb.Ping{Message: "pong"})
+	})
+
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	dial := func() (*Client, *Conn) {
+		client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res Request
+		assert.NoError(t, client.Call(context.Background(), &pb.Ping{}, &res))
+		return client, <-conns
+	}
+	recv := func(client *Client) string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		res, err := client.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg pb.Ping
+		assert.NoError(t, proto.Unmarshal(res.Data.([]byte), &msg))
+		assert.Equal(t, uint32(0), res.StreamID)
+		return msg.Message
+	}
+
+	c1, hc1 := dial()
+	defer c1.Close()
+	c2, hc2 := dial()
+	defer c2.Close()
+	assert.NotEqual(t, hc1.ID(), hc2.ID())
+	assert.Equal(t, c1.rwc.LocalAddr().String(), hc1.RemoteAddr().String())
+
+	// the connections are looked up by the ids
+	hc, ok := server.Conn(hc2.ID())
+	assert.True(t, ok)
+	assert.True(t, hc == hc2)
+	assert.Equal(t, 2, len(server.Conns()))
+
+	// the messages are pushed outside of the requests
+	assert.NoError(t, hc.Push(&pb.Ping{Message: "hello"}))
+	assert.Equal(t, "hello", recv(c2))
+
+	// and by the handler, to the other connections
+	var res Request
+	assert.NoError(t, c1.Call(context.Background(), &pb.Ping{Message: "all"}, &res))
+	<-conns
+	assert.Equal(t, "broadcast", recv(c1))
+	assert.Equal(t, "broadcast", recv(c2))
+
+	// the messages can not be pushed to the closed connections
+	c2.Close()
+	assert.Eventually(t, func() bool {
+		_, ok := server.Conn(hc2.ID())
+		return !ok
+	}, time.Second, time.Millisecond*5)
+	assert.Equal(t, ErrConnClosed, hc2.Push(&pb.Ping{Message: "hello"}))
+	assert.Error(t, hc1.Push("not a message"))
+}
+
+func TestPushQueueFull(t *testing.T) {
+	server := &Server{Codec: &ProtobufCodec{}, MaxPushQueue: 1}
+	c := server.newConn(nil)
+
+	// the messages are queued, until the preface is exchanged
+	assert.NoError(t, c.handle.Push(&pb.Ping{Message: "1"}))
+	assert.Equal(t, ErrPushQueueFull, c.handle.Push(&pb.Ping{Message: "2"}))
+
+	c.closePushes()
+	assert.Equal(t, ErrConnClosed, c.handle.Push(&pb.Ping{Message: "3"}))
+}
+
+func TestPushWhileHandling(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, release := make(chan *Conn, 1), make(chan struct{})
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		conns <- c.Conn()
+		<-release
+		c.Write(&pb.Ping{Message: "pong"})
+	})
+	server := &Server{Handler: router, Codec: &ProtobufCodec{}}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		var res Request
+		done <- client.Call(context.Background(), &pb.Ping{}, &res)
+	}()
+
+	// the message is written, while the handler of the conn is running
+	assert.NoError(t, (<-conns).Push(&pb.Ping{Message: "hello"}))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := client.Recv(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", readPingMessage(*res))
+
+	close(release)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,208 @@
+package gotham
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitedKey is the key of the Context set to true, when the request
+// is limited by the RateLimit middleware, so the logger may report it.
+const RateLimitedKey = "gotham/ratelimited"
+
+// RateLimitAction is the action taken on the requests exceeding the rate.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the request silently, the connection is kept.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitReply drops the request, and replies with the status
+	// 429 Too Many Requests and the Reply of the config, if any.
+	RateLimitReply
+	// RateLimitClose aborts the request, and closes the connection.
+	RateLimitClose
+)
+
+// RateLimitConfig defines the config for RateLimit middleware.
+type RateLimitConfig struct {
+	// Rate is the number of the requests allowed per second.
+	Rate float64
+	// Burst is the number of the requests allowed at once, which is the
+	// size of the token bucket. Optional. Default value is 1.
+	Burst int
+
+	// Key returns the key of the request, the requests of the same key share
+	// a token bucket. Optional. Default value is gotham.RateLimitByConn.
+	Key func(*Context) string
+
+	// Action is taken on the requests exceeding the rate.
+	// Optional. Default value is gotham.RateLimitDrop.
+	Action RateLimitAction
+	// Reply is the message written by RateLimitReply. Optional.
+	Reply interface{}
+
+	// Stats counts the requests allowed and limited. Optional.
+	Stats *RateLimitStats
+
+	// now is the clock of the buckets, it is replaced by the tests.
+	now func() time.Time
+}
+
+// RateLimitStats counts the requests of the RateLimit middleware,
+// it is safe for concurrent use.
+type RateLimitStats struct {
+	allowed uint64
+	limited uint64
+}
+
+// Allowed returns the number of the requests allowed.
+func (s *RateLimitStats) Allowed() uint64 {
+	return atomic.LoadUint64(&s.allowed)
+}
+
+// Limited returns the number of the requests exceeding the rate.
+func (s *RateLimitStats) Limited() uint64 {
+	return atomic.LoadUint64(&s.limited)
+}
+
+// RateLimitByConn keys the requests by their connections.
+func RateLimitByConn(c *Context) string {
+	return strconv.FormatUint(c.Request.ConnID(), 10)
+}
+
+// RateLimitByIP keys the requests by the IP of their clients, so the
+// connections of the same client share the rate.
+func RateLimitByIP(c *Context) string {
+	addr := c.Request.RemoteAddr()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// RateLimitByRoute keys the requests by their TypeURL, so all the
+// clients share the rate of each route.
+func RateLimitByRoute(c *Context) string {
+	return c.Request.TypeURL
+}
+
+// RateLimit returns a middleware, which drops the requests of each
+// connection exceeding the rate per second, after the burst.
+func RateLimit(rate float64, burst int) HandlerFunc {
+	return RateLimitWithConfig(RateLimitConfig{Rate: rate, Burst: burst})
+}
+
+// RateLimitWithConfig returns a RateLimit middleware with config.
+func RateLimitWithConfig(conf RateLimitConfig) HandlerFunc {
+	if conf.Burst <= 0 {
+		conf.Burst = 1
+	}
+	if conf.Key == nil {
+		conf.Key = RateLimitByConn
+	}
+	if conf.now == nil {
+		conf.now = time.Now
+	}
+	limiter := &rateLimiter{
+		rate:    conf.Rate,
+		burst:   float64(conf.Burst),
+		buckets: make(map[string]*tokenBucket),
+		sweepAt: minSweepBuckets,
+	}
+
+	return func(c *Context) {
+		if limiter.allow(conf.Key(c), conf.now()) {
+			if conf.Stats != nil {
+				atomic.AddUint64(&conf.Stats.allowed, 1)
+			}
+			c.Next()
+			return
+		}
+
+		if conf.Stats != nil {
+			atomic.AddUint64(&conf.Stats.limited, 1)
+		}
+		c.Set(RateLimitedKey, true)
+
+		switch conf.Action {
+		case RateLimitReply:
+			c.index = abortIndex
+			c.Writer.SetStatus(http.StatusTooManyRequests)
+			if conf.Reply != nil {
+				c.Writer.Write(conf.Reply)
+			}
+		case RateLimitClose:
+			c.Abort()
+			c.Writer.SetStatus(http.StatusTooManyRequests)
+		default:
+			c.index = abortIndex
+		}
+	}
+}
+
+// minSweepBuckets is the number of the buckets,
+// which are kept without sweeping the idle ones.
+const minSweepBuckets = 1024
+
+// tokenBucket holds the tokens of a key, which are refilled by the rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps the token buckets of the keys. The buckets refilled
+// completely are swept, when the number of the buckets doubles, so the
+// buckets of the closed connections are not kept forever.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	sweepAt int
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.sweepAt {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < minSweepBuckets {
+		l.sweepAt = minSweepBuckets
+	}
+}
@@ -0,0 +1,144 @@
+package gotham
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// statusWriter records the status, the keepalive and the messages written.
+type statusWriter struct {
+	status    int
+	keepAlive bool
+	messages  []interface{}
+}
+
+func newStatusWriter() *statusWriter {
+	return &statusWriter{status: http.StatusOK, keepAlive: true}
+}
+
+func (sw *statusWriter) Flush() error            { return nil }
+func (sw *statusWriter) Buffered() int           { return 0 }
+func (sw *statusWriter) SetStatus(code int)      { sw.status = code }
+func (sw *statusWriter) Status() int             { return sw.status }
+func (sw *statusWriter) KeepAlive() bool         { return sw.keepAlive }
+func (sw *statusWriter) SetKeepAlive(value bool) { sw.keepAlive = value }
+func (sw *statusWriter) Write(data interface{}) error {
+	sw.messages = append(sw.messages, data)
+	return nil
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Now()
+	stats := &RateLimitStats{}
+	limited := 0
+	handled := 0
+
+	router := New()
+	router.Use(func(c *Context) {
+		c.Next()
+		if c.GetBool(RateLimitedKey) {
+			limited++
+		}
+	})
+	router.Use(RateLimitWithConfig(RateLimitConfig{
+		Rate:  10,
+		Burst: 2,
+		Key:   RateLimitByRoute,
+		Stats: stats,
+		now:   func() time.Time { return now },
+	}))
+	router.Handle("pb.Ping", func(c *Context) { handled++ })
+	router.Handle("pb.Pong", func(c *Context) { handled++ })
+
+	serve := func(path string) *statusWriter {
+		w := newStatusWriter()
+		router.ServeProto(w, &Request{TypeURL: path})
+		return w
+	}
+
+	// the burst is allowed, the rest is dropped silently
+	for i := 0; i < 4; i++ {
+		w := serve("pb.Ping")
+		assert.Equal(t, http.StatusOK, w.status)
+		assert.True(t, w.keepAlive)
+	}
+	assert.Equal(t, 2, handled)
+	assert.Equal(t, 2, limited)
+	assert.Equal(t, uint64(2), stats.Allowed())
+	assert.Equal(t, uint64(2), stats.Limited())
+
+	// the routes are keyed separately
+	serve("pb.Pong")
+	assert.Equal(t, 3, handled)
+
+	// the tokens are refilled by the rate
+	now = now.Add(time.Millisecond * 100)
+	serve("pb.Ping")
+	serve("pb.Ping")
+	assert.Equal(t, 4, handled)
+}
+
+func TestRateLimitActions(t *testing.T) {
+	reply := "slow down"
+	for action, check := range map[RateLimitAction]func(w *statusWriter){
+		RateLimitDrop: func(w *statusWriter) {
+			assert.Equal(t, http.StatusOK, w.status)
+			assert.True(t, w.keepAlive)
+			assert.Empty(t, w.messages)
+		},
+		RateLimitReply: func(w *statusWriter) {
+			assert.Equal(t, http.StatusTooManyRequests, w.status)
+			assert.True(t, w.keepAlive)
+			assert.Equal(t, []interface{}{reply}, w.messages)
+		},
+		RateLimitClose: func(w *statusWriter) {
+			assert.Equal(t, http.StatusTooManyRequests, w.status)
+			assert.False(t, w.keepAlive)
+			assert.Empty(t, w.messages)
+		},
+	} {
+		router := New()
+		router.Use(RateLimitWithConfig(RateLimitConfig{Rate: 0.001, Action: action, Reply: reply}))
+		router.Handle("pb.Ping", func(c *Context) {})
+
+		w := newStatusWriter()
+		router.ServeProto(w, &Request{TypeURL: "pb.Ping"})
+		assert.Equal(t, http.StatusOK, w.status)
+
+		w = newStatusWriter()
+		router.ServeProto(w, &Request{TypeURL: "pb.Ping"})
+		check(w)
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	server := &Server{}
+	c := server.newConn(nil)
+	c.remoteAddr = "10.0.0.1:5000"
+	ctx := &Context{Request: &Request{conn: c, TypeURL: "pb.Ping"}}
+
+	assert.Equal(t, "1", RateLimitByConn(ctx))
+	assert.Equal(t, "10.0.0.1", RateLimitByIP(ctx))
+	assert.Equal(t, "pb.Ping", RateLimitByRoute(ctx))
+
+	ctx.Request.conn = nil
+	assert.Equal(t, "0", RateLimitByConn(ctx))
+	assert.Equal(t, "0.0.0.0", RateLimitByIP(ctx))
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Now()
+	l := &rateLimiter{rate: 1, burst: 1, buckets: make(map[string]*tokenBucket), sweepAt: 2}
+	assert.True(t, l.allow("a", now))
+	assert.False(t, l.allow("a", now))
+	assert.True(t, l.allow("b", now))
+
+	// the idle buckets are swept, when the new ones are added
+	now = now.Add(time.Second)
+	assert.True(t, l.allow("c", now))
+	assert.Equal(t, 1, len(l.buckets))
+	assert.Equal(t, minSweepBuckets, l.sweepAt)
+}
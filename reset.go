@@ -0,0 +1,55 @@
+package gotham
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrStreamReset is returned by Client.Call, after the server discarded
+// the request, such as the one exceeding its MaxReadFrameSize or
+// MaxMessageSize. The errors returned are of type *StreamError, which
+// matches ErrStreamReset with errors.Is.
+var ErrStreamReset = errors.New("tcp: stream reset")
+
+// resetPayloadLen is the length of the RST_STREAM frame payload,
+// 4 bytes of the error code.
+const resetPayloadLen = 4
+
+// StreamError is returned by Client.Call, after the server sent the
+// RST_STREAM frame for the stream of the call. The request was never
+// handled by the server.
+type StreamError struct {
+	// StreamID is the stream id of the request discarded.
+	StreamID uint32
+	// Code is the reason of the discard.
+	Code ErrCode
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("%v: stream %d, code %v", ErrStreamReset, e.StreamID, e.Code)
+}
+
+// Is reports whether the target is ErrStreamReset.
+func (e *StreamError) Is(target error) bool {
+	return target == ErrStreamReset
+}
+
+// resetStream sends the RST_STREAM frame with the code for the stream.
+func (c *conn) resetStream(streamID uint32, code ErrCode) error {
+	payload := make([]byte, resetPayloadLen)
+	binary.BigEndian.PutUint32(payload, uint32(code))
+	return c.writeControlFrame(FrameHeader{Type: FrameRSTStream, StreamID: streamID}, payload)
+}
+
+// processResetStream fails the call of the stream discarded by the server.
+func (c *Client) processResetStream(fh FrameHeader, payload []byte) error {
+	if len(payload) != resetPayloadLen {
+		return ErrFrameSize
+	}
+	c.failCall(fh.StreamID, &StreamError{
+		StreamID: fh.StreamID,
+		Code:     ErrCode(binary.BigEndian.Uint32(payload)),
+	})
+	return nil
+}
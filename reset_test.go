@@ -0,0 +1,118 @@
+package gotham
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDiscardReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discards := make(chan error, 2)
+	server := &Server{Handler: New(), Codec: &ProtobufCodec{}}
+	server.MaxReadFrameSize = 64
+	server.MaxMessageSize = 1024
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.OnDiscard = func(_ net.Conn, _ FrameHeader, err error) { discards <- err }
+	go server.Serve(ln)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchangePreface(t, conn)
+
+	// the calls of the oversize frame and the oversize message are reset
+	w := newBufioWriter(conn)
+	writeData(w, 1, make([]byte, 128))
+	(&Framer{MaxWriteFrameSize: 64}).writeData(w, 3, make([]byte, 2048))
+	w.Flush()
+
+	r := newBufioReader(conn)
+	for _, id := range []uint32{1, 3} {
+		var fh FrameHeader
+		var payload []byte
+		for fh.Type != FrameRSTStream {
+			if fh, err = ReadFrameHeader(r); err != nil {
+				t.Fatal(err)
+			}
+			if payload, err = readFramePayload(r, fh); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, id, fh.StreamID)
+		assert.Equal(t, ErrCodeFrameSize, ErrCode(binary.BigEndian.Uint32(payload)))
+	}
+	assert.True(t, errors.Is(<-discards, ErrFrameTooLarge))
+	assert.Equal(t, ErrMessageTooLarge, <-discards)
+
+	// or the client is told by the GOAWAY frame
+	server.SendGoAwayOnError = true
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchangePreface(t, conn)
+
+	w = newBufioWriter(conn)
+	writeData(w, 1, make([]byte, 128))
+	w.Flush()
+	assert.Equal(t, ErrCodeFrameSize, readGoAway(t, newBufioReader(conn)))
+	assert.True(t, errors.Is(<-discards, ErrFrameTooLarge))
+}
+
+func TestClientStreamReset(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	go func() {
+		ReadPreface(c2)
+		r := newBufioReader(c2)
+		go func() {
+			// the call of the first DATA frame is reset
+			for {
+				fh, err := ReadFrameHeader(r)
+				if err != nil {
+					return
+				}
+				if _, err := readFramePayload(r, fh); err != nil {
+					return
+				}
+				if fh.Type == FrameData {
+					payload := make([]byte, resetPayloadLen)
+					binary.BigEndian.PutUint32(payload, uint32(ErrCodeFrameSize))
+					w := newBufioWriter(c2)
+					writeFrame(w, FrameHeader{Type: FrameRSTStream, StreamID: fh.StreamID}, payload)
+					w.Flush()
+				}
+			}
+		}()
+		WritePreface(c2, ProtocolVersion)
+	}()
+
+	client := (&Dialer{Codec: &ProtobufCodec{}}).NewClient(c1)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var res Request
+	err := client.Call(ctx, &pb.Ping{Message: strings.Repeat("a", 128)}, &res)
+	assert.True(t, errors.Is(err, ErrStreamReset), "%v", err)
+	assert.Equal(t, &StreamError{StreamID: 1, Code: ErrCodeFrameSize}, err)
+	assert.Equal(t, "tcp: stream reset: stream 1, code FRAME_SIZE_ERROR", err.Error())
+}
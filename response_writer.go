@@ -1,9 +1,12 @@
 package gotham
 
 import (
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"io"
 	"net/http"
+	"sync/atomic"
 )
 
 const (
@@ -45,12 +48,26 @@ type ResponseWriter interface {
 	Write(data interface{}) error
 }
 
+// messageWriter frames each message written, as a whole, into the writer,
+// which is shared with the other goroutines, see connWriter.
+type messageWriter interface {
+	writeMessage(fr *Framer, streamID uint32, data []byte) error
+}
+
 // responseWriter implements interface ResponseWriter
 type responseWriter struct {
 	writer    io.Writer
 	status    int
 	keepAlive bool
 	codec     Codec
+	// streamID of the request, which the responses are written with.
+	streamID uint32
+	// framer limits the size of the responses.
+	framer *Framer
+	// flushEach flushes every message written, see FlushPerMessage.
+	flushEach bool
+	// conn counts the messages written, if any.
+	conn *conn
 }
 
 func NewResponseWriter(w io.Writer, c Codec) *responseWriter {
@@ -59,6 +76,7 @@ func NewResponseWriter(w io.Writer, c Codec) *responseWriter {
 	rw.keepAlive = true
 	rw.status = defaultStatus
 	rw.codec = c
+	rw.framer = defaultFramer
 	return rw
 }
 
@@ -93,7 +111,32 @@ func (rw *responseWriter) Flush() error {
 }
 
 func (rw *responseWriter) Write(data interface{}) error {
-	return WriteFrame(rw.writer, data, rw.codec)
+	buf, err := rw.codec.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if mw, ok := rw.writer.(messageWriter); ok {
+		err = mw.writeMessage(rw.getFramer(), rw.streamID, buf)
+	} else {
+		err = rw.getFramer().writeData(rw.writer, rw.streamID, buf)
+	}
+	if err != nil {
+		return err
+	}
+	if rw.conn != nil {
+		atomic.AddUint64(&rw.conn.messagesWritten, 1)
+	}
+	if rw.flushEach {
+		return rw.Flush()
+	}
+	return nil
+}
+
+func (rw *responseWriter) getFramer() *Framer {
+	if rw.framer != nil {
+		return rw.framer
+	}
+	return defaultFramer
 }
 
 type respRecorder struct {
@@ -106,45 +149,77 @@ func (rr *respRecorder) Write(data interface{}) error {
 	rr.Message = data
 
 	if rr.writer != nil {
-		return WriteFrame(rr.writer, data, rr.codec)
+		buf, err := rr.codec.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return rr.getFramer().writeData(rr.writer, rr.streamID, buf)
 	}
 	return nil
 }
 
 // WriteFrame with given url
 func WriteFrame(w io.Writer, data interface{}, codec Codec) error {
-	// marshal the payload pb
-	buf, err := codec.Marshal(data)
-	if err != nil {
-		return err
-	}
-
-	return WriteData(w, buf)
+	return defaultFramer.WriteFrame(w, data, codec)
 }
 
 // WriteData with the payload.
 func WriteData(w io.Writer, data []byte) (err error) {
-	var flags Flags
+	return defaultFramer.WriteData(w, data)
+}
+
+// writeData with the payload, the stream id is written after
+// the frame header, if it is not zero.
+func writeData(w io.Writer, streamID uint32, data []byte) (err error) {
+	return defaultFramer.writeData(w, streamID, data)
+}
+
+// writeFrame with the header and the payload, the length and
+// the common flags of the header are set by the payload.
+//
+// The header, the payload and the checksum are written by net.Buffers,
+// so the payload is never copied into a frame. The Server and the Client
+// write through a bufio.Writer, which copies the payload into its buffer,
+// or writes the payload larger than the buffer to the conn directly.
+// Only a net.Conn written directly is written by writev.
+func writeFrame(w io.Writer, fh FrameHeader, data []byte) (err error) {
+	flags := fh.Flags
 	// flags |= FlagDataEndStream
 	flags |= FlagFrameAck
 
 	length := len(data)
-	if length >= (1 << 24) {
-		return ErrFrameTooLarge
+	if length > maxFrameSize {
+		return &FrameTooLargeError{Length: uint32(length), Max: maxFrameSize}
+	}
+
+	hlen := frameHeaderLen
+	if fh.StreamID != 0 {
+		flags |= FlagFrameStream
+		hlen += streamIDLen
 	}
 
-	header := [frameHeaderLen]byte{
+	fb := getFrameBuffers()
+	defer putFrameBuffers(fb)
+
+	fb.header = [frameHeaderLen + streamIDLen]byte{
 		byte(length >> 16),
 		byte(length >> 8),
 		byte(length),
-		byte(FrameData),
+		byte(fh.Type),
 		byte(flags),
 	}
-	wbuf := append(header[:frameHeaderLen], data...)
+	binary.BigEndian.PutUint32(fb.header[frameHeaderLen:], fh.StreamID)
+	fb.bufs = append(fb.array[:0], fb.header[:hlen], data)
+	total := hlen + length
+	if flags.Has(FlagFrameChecksum) {
+		binary.BigEndian.PutUint32(fb.sum[:], crc32.Checksum(data, crcTable))
+		fb.bufs = append(fb.bufs, fb.sum[:])
+		total += checksumLen
+	}
 
-	n, err := w.Write(wbuf)
+	n, err := fb.bufs.WriteTo(w)
 
-	if err == nil && n != len(wbuf) {
+	if err == nil && n != int64(total) {
 		err = io.ErrShortWrite
 	}
 
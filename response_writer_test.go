@@ -48,6 +48,7 @@ func TestResponseWriterFlush(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	exchangePreface(t, conn)
 
 	w := bufio.NewWriter(conn)
 	rw := NewResponseWriter(w, &ProtobufCodec{})
@@ -60,3 +61,70 @@ func TestResponseWriterFlush(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 0, rw.Buffered())
 }
+
+// writesRecorder records the slices written into it.
+type writesRecorder struct {
+	writes [][]byte
+}
+
+func (wr *writesRecorder) Write(p []byte) (int, error) {
+	wr.writes = append(wr.writes, p)
+	return len(p), nil
+}
+
+func TestWriteFrameNoCopy(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+
+	// the payload is written as it is, after the header
+	var wr writesRecorder
+	assert.NoError(t, writeFrame(&wr, FrameHeader{Type: FrameData, StreamID: 7}, payload))
+	assert.Equal(t, 2, len(wr.writes))
+	assert.Equal(t, frameHeaderLen+streamIDLen, len(wr.writes[0]))
+	assert.True(t, &payload[0] == &wr.writes[1][0])
+
+	// and followed by the checksum
+	wr.writes = nil
+	assert.NoError(t, writeFrame(&wr, FrameHeader{Type: FrameData, Flags: FlagFrameChecksum}, payload))
+	assert.Equal(t, 3, len(wr.writes))
+	assert.Equal(t, frameHeaderLen, len(wr.writes[0]))
+	assert.True(t, &payload[0] == &wr.writes[1][0])
+	assert.Equal(t, checksumLen, len(wr.writes[2]))
+
+	// the frame is read back
+	var buf bytes.Buffer
+	for _, p := range wr.writes {
+		buf.Write(p)
+	}
+	fh, err := ReadFrameHeader(&buf)
+	assert.NoError(t, err)
+	body, err := readFramePayload(&buf, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, body)
+
+	// the header and the payload are written by writev to the net.Conn
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		writeFrame(conn, FrameHeader{Type: FrameData, StreamID: 7}, payload)
+		conn.Close()
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fh, err = ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), fh.StreamID)
+	body, err = readFramePayload(r, fh)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, body)
+}
@@ -40,6 +40,8 @@ type Router struct {
 
 	allNoRoute HandlersChain
 	noRoute    HandlersChain
+	allAuth    HandlersChain
+	auth       HandlersChain
 	pool       sync.Pool
 
 	nodes  pnodes
@@ -113,6 +115,16 @@ func (router *Router) rebuild404Handlers() {
 		panic("too many handlers")
 	}
 	router.allNoRoute = append(router.handlers, router.noRoute...)
+
+	// the chains never share the array of the global middlewares
+	router.allAuth = nil
+	if len(router.auth) > 0 {
+		if len(router.handlers)+len(router.auth) >= int(abortIndex) {
+			panic("too many handlers")
+		}
+		router.allAuth = make(HandlersChain, 0, len(router.handlers)+len(router.auth))
+		router.allAuth = append(append(router.allAuth, router.handlers...), router.auth...)
+	}
 }
 
 func (router *Router) addRoute(path string, handlers HandlersChain) {
@@ -148,6 +160,16 @@ func (r *Router) Run(addr string, codec Codec) (err error) {
 	return
 }
 
+// RunTLS attaches the router to a Server and starts listening and serving
+// TLS requests, see Server.ListenAndServeTLS for the certificate files.
+// It is a shortcut for ListenAndServeTLS(addr, certFile, keyFile, router, codec).
+func (r *Router) RunTLS(addr, certFile, keyFile string, codec Codec) (err error) {
+	debugPrint("Listening and serving TLS on %s\n", addr)
+	defer func() { debugPrintError(err) }()
+	err = ListenAndServeTLS(addr, certFile, keyFile, r, codec)
+	return
+}
+
 // HandleContext re-enter a context that has been rewritten.
 // This can be done by setting c.Request.URL.Path to your new target.
 // Disclaimer: You can loop yourself to death with this, use wisely.
@@ -174,6 +196,13 @@ func (r *Router) ServeProto(w ResponseWriter, req *Request) {
 }
 
 func (router *Router) handleProtoRequest(c *Context) {
+	// the messages of the connection not authenticated yet
+	if router.allAuth != nil && !c.Request.Authenticated() {
+		c.handlers = router.allAuth
+		c.Next()
+		return
+	}
+
 	// Find route in the tree
 	// url, _ := fixPath(c.Request.URL)
 	value := router.nodes.get(c.Request.TypeURL)
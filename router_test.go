@@ -143,6 +143,7 @@ func TestRouterServe(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	exchangePreface(t, conn)
 	// write request
 	// log.Println("write data to server")
 
@@ -0,0 +1,285 @@
+package gotham
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrHandshake is returned when the secure channel can not be established,
+// such as the peers with different keys, or the peer without encryption.
+var ErrHandshake = errors.New("tcp: secure handshake failed")
+
+// ErrRecord is returned when a record can not be authenticated, which is
+// corrupted, forged, replayed or reordered. The connection is unusable after it.
+var ErrRecord = errors.New("tcp: secure record authentication failed")
+
+// SecureConfig configures the secure channel, which encrypts and
+// authenticates all the traffic of a connection.
+//
+// The peers exchange the ephemeral X25519 keys at the start of the
+// connection, then every record is sealed by ChaCha20-Poly1305, with
+// the keys of its direction. The nonces are the sequence numbers of the
+// records, which are never sent, so the replayed or reordered records
+// can not be opened.
+type SecureConfig struct {
+	// Key is an optional pre-shared key, which is mixed into the session
+	// keys. Without it, the channel is encrypted, but the peers are not
+	// authenticated. Both of the peers must use the same key.
+	Key []byte
+
+	// HandshakeTimeout is the maximum duration of the handshake.
+	// If zero, there is no timeout.
+	HandshakeTimeout time.Duration
+}
+
+const (
+	// secureVersion is the version of the handshake.
+	secureVersion = 0x1
+	// maxRecordPayload is the maximum plaintext size of a record.
+	maxRecordPayload = 1 << 14
+	// recordHeaderLen is the length of the record header,
+	// which is the 2 bytes length of the sealed record.
+	recordHeaderLen = 2
+)
+
+// SecureConn is a net.Conn secured by the SecureConfig. The handshake is
+// run by the first Read or Write, unless Handshake is called explicitly.
+type SecureConn struct {
+	net.Conn
+
+	config   *SecureConfig
+	isClient bool
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	// rmu guards the reading side.
+	rmu  sync.Mutex
+	in   cipher.AEAD
+	rseq uint64
+	rbuf []byte // plaintext not read yet
+	rerr error
+
+	// wmu guards the writing side.
+	wmu  sync.Mutex
+	out  cipher.AEAD
+	wseq uint64
+	werr error
+}
+
+// SecureServer returns a SecureConn of the server side of the conn.
+func SecureServer(conn net.Conn, config *SecureConfig) *SecureConn {
+	return &SecureConn{Conn: conn, config: config}
+}
+
+// SecureClient returns a SecureConn of the client side of the conn.
+func SecureClient(conn net.Conn, config *SecureConfig) *SecureConn {
+	return &SecureConn{Conn: conn, config: config, isClient: true}
+}
+
+// Handshake runs the handshake, if it has not yet been run.
+func (sc *SecureConn) Handshake() error {
+	sc.handshakeOnce.Do(func() {
+		if d := sc.config.HandshakeTimeout; d != 0 {
+			sc.Conn.SetDeadline(time.Now().Add(d))
+			defer sc.Conn.SetDeadline(time.Time{})
+		}
+		sc.handshakeErr = sc.handshake()
+	})
+	return sc.handshakeErr
+}
+
+// handshake exchanges the public keys, derives the session keys from them,
+// then confirms the keys by an empty record sealed by each of the peers.
+func (sc *SecureConn) handshake() error {
+	var priv, pub [curve25519.ScalarSize]byte
+	if _, err := io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return err
+	}
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	var hello, peer [1 + curve25519.PointSize]byte
+	hello[0] = secureVersion
+	copy(hello[1:], pub[:])
+
+	// the client says hello first, so the server never
+	// writes anything to the clients without encryption
+	if sc.isClient {
+		if _, err := sc.Conn.Write(hello[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := io.ReadFull(sc.Conn, peer[:]); err != nil {
+		return err
+	}
+	if peer[0] != secureVersion {
+		return ErrHandshake
+	}
+	if !sc.isClient {
+		if _, err := sc.Conn.Write(hello[:]); err != nil {
+			return err
+		}
+	}
+
+	secret, err := curve25519.X25519(priv[:], peer[1:])
+	if err != nil {
+		return ErrHandshake
+	}
+
+	clientPub, serverPub := hello[1:], peer[1:]
+	if !sc.isClient {
+		clientPub, serverPub = serverPub, clientPub
+	}
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+	kdf := hkdf.New(sha256.New, append(secret, sc.config.Key...), salt, []byte("gotham secure channel"))
+
+	var keys [2 * chacha20poly1305.KeySize]byte
+	if _, err := io.ReadFull(kdf, keys[:]); err != nil {
+		return err
+	}
+	c2s, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	s2c, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return err
+	}
+
+	if sc.isClient {
+		sc.in, sc.out = s2c, c2s
+	} else {
+		sc.in, sc.out = c2s, s2c
+	}
+
+	// the server confirms first, so the peers never write at the same
+	// time, which blocks the unbuffered transports, such as net.Pipe
+	if sc.isClient {
+		if err := sc.readConfirm(); err != nil {
+			return err
+		}
+		return sc.writeRecord(nil)
+	}
+	if err := sc.writeRecord(nil); err != nil {
+		return err
+	}
+	return sc.readConfirm()
+}
+
+// readConfirm reads the empty record, which confirms the peer has the same keys.
+func (sc *SecureConn) readConfirm() error {
+	if _, err := sc.readRecord(); err != nil {
+		if err == ErrRecord {
+			return ErrHandshake
+		}
+		return err
+	}
+	return nil
+}
+
+// Read reads the plaintext of the records.
+func (sc *SecureConn) Read(p []byte) (int, error) {
+	if err := sc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	sc.rmu.Lock()
+	defer sc.rmu.Unlock()
+
+	for len(sc.rbuf) == 0 {
+		if sc.rerr != nil {
+			return 0, sc.rerr
+		}
+		sc.rbuf, sc.rerr = sc.readRecord()
+	}
+
+	n := copy(p, sc.rbuf)
+	sc.rbuf = sc.rbuf[n:]
+	return n, nil
+}
+
+// Write seals the data into the records.
+func (sc *SecureConn) Write(p []byte) (int, error) {
+	if err := sc.Handshake(); err != nil {
+		return 0, err
+	}
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+
+	if sc.werr != nil {
+		return 0, sc.werr
+	}
+
+	var n int
+	for len(p) > 0 {
+		m := len(p)
+		if m > maxRecordPayload {
+			m = maxRecordPayload
+		}
+		if err := sc.writeRecord(p[:m]); err != nil {
+			// the sequence of the records is broken
+			sc.werr = err
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+func (sc *SecureConn) readRecord() ([]byte, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(sc.Conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[:]))
+	if length < sc.in.Overhead() {
+		return nil, ErrRecord
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(sc.Conn, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	plain, err := sc.in.Open(record[:0], recordNonce(sc.rseq), record, header[:])
+	if err != nil {
+		return nil, ErrRecord
+	}
+	sc.rseq++
+	return plain, nil
+}
+
+func (sc *SecureConn) writeRecord(data []byte) error {
+	length := len(data) + sc.out.Overhead()
+	buf := make([]byte, recordHeaderLen, recordHeaderLen+length)
+	binary.BigEndian.PutUint16(buf, uint16(length))
+
+	buf = sc.out.Seal(buf, recordNonce(sc.wseq), data, buf[:recordHeaderLen])
+	sc.wseq++
+
+	_, err := sc.Conn.Write(buf)
+	return err
+}
+
+// recordNonce returns the nonce of the record, which is its sequence number.
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], seq)
+	return nonce
+}
@@ -0,0 +1,150 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+// tapConn records the last data written into the conn.
+type tapConn struct {
+	net.Conn
+	last []byte
+}
+
+func (tc *tapConn) Write(p []byte) (int, error) {
+	tc.last = append(tc.last[:0], p...)
+	return tc.Conn.Write(p)
+}
+
+func TestSecureConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	tap := &tapConn{Conn: c1}
+	config := &SecureConfig{Key: []byte("gotham")}
+	client, server := SecureClient(tap, config), SecureServer(c2, config)
+
+	// the data is split into the records, and echoed back
+	go io.Copy(server, io.LimitReader(server, 40000))
+	msg := bytes.Repeat([]byte("gotham"), 6000)
+	go client.Write(msg)
+	echo := make([]byte, len(msg))
+	_, err := io.ReadFull(client, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, echo)
+
+	// the data is never sent without encryption
+	assert.False(t, bytes.Contains(tap.last, []byte("gotham")))
+	client.Close()
+	server.Close()
+
+	c1, c2 = net.Pipe()
+	tap = &tapConn{Conn: c1}
+	client, server = SecureClient(tap, config), SecureServer(c2, config)
+
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// the replayed record can not be opened
+	go tap.Conn.Write(tap.last)
+	_, err = server.Read(buf)
+	assert.Equal(t, ErrRecord, err)
+	// and the connection is unusable after it
+	_, err = server.Read(buf)
+	assert.Equal(t, ErrRecord, err)
+	client.Close()
+	server.Close()
+
+	// the peers with different keys can not talk
+	c1, c2 = net.Pipe()
+	client = SecureClient(c1, config)
+	server = SecureServer(c2, &SecureConfig{Key: []byte("batman")})
+	go server.Handshake()
+	assert.Equal(t, ErrHandshake, client.Handshake())
+	client.Close()
+	server.Close()
+
+	// the peer without encryption is rejected
+	c1, c2 = net.Pipe()
+	server = SecureServer(c2, &SecureConfig{HandshakeTimeout: time.Second})
+	go c1.Write(make([]byte, 33))
+	assert.Equal(t, ErrHandshake, server.Handshake())
+	c1.Close()
+	server.Close()
+}
+
+func TestServerSecure(t *testing.T) {
+	addr := "127.0.0.1:9006"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: readPingMessage(*c.Request) + " Pong"})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.SecureConfig = &SecureConfig{Key: []byte("gotham"), HandshakeTimeout: time.Second}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	client, err := (&Dialer{
+		Codec:        &ProtobufCodec{},
+		SecureConfig: &SecureConfig{Key: []byte("gotham")},
+	}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, "Ping Pong", readPingMessage(res))
+	client.Close()
+
+	// the dialer with a different key fails at the handshake
+	_, err = (&Dialer{
+		Codec:        &ProtobufCodec{},
+		SecureConfig: &SecureConfig{Key: []byte("batman")},
+	}).Dial("tcp", addr)
+	assert.Equal(t, ErrHandshake, err)
+
+	// the client without encryption is disconnected
+	client, err = (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	assert.Error(t, client.Call(ctx, &pb.Ping{Message: "Ping"}, &res))
+	client.Close()
+}
+
+func TestServerSecureReadTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Handler: New(), Codec: &ProtobufCodec{}, ReadTimeout: time.Millisecond * 50}
+	server.SecureConfig = &SecureConfig{Key: []byte("gotham")}
+	go server.Serve(ln)
+	defer server.Close()
+
+	// the peer sending nothing is disconnected by the ReadTimeout,
+	// without the HandshakeTimeout
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(server.Conns()) == 0
+	}, time.Second, time.Millisecond*5)
+}
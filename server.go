@@ -2,6 +2,9 @@ package gotham
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -20,6 +23,9 @@ type Handler interface {
 	ServeProto(ResponseWriter, *Request)
 }
 
+// Codec encodes and decodes the messages. The data unmarshaled is valid
+// only until the handler of the request returns, so the codec may keep
+// referencing it from the Request's Data, without copying it.
 type Codec interface {
 	Marshal(v interface{}) ([]byte, error)
 	Unmarshal(data []byte, req *Request) error
@@ -44,6 +50,128 @@ type Server struct {
 	// next request.
 	IdleTimeout time.Duration
 
+	// MaxConcurrentRequests is the maximum number of requests handled
+	// concurrently on each connection. The reading of the connection is
+	// paused, when the limit is reached. The responses are written by a
+	// dedicated goroutine, in the order the requests are finished.
+	// If zero or one, the requests are handled one at a time, and the
+	// responses are written in the order the requests were read.
+	MaxConcurrentRequests int
+
+	// FlushPolicy decides when the responses are flushed to the clients,
+	// the handlers may flush them immediately by Context.Flush anyway.
+	// The default is FlushPerRequest.
+	FlushPolicy FlushPolicy
+	// FlushDelay is the maximum delay of the responses coalesced by
+	// FlushCoalesce. If zero, one millisecond is used.
+	FlushDelay time.Duration
+	// FlushSize is the number of the bytes buffered, which flushes the
+	// responses coalesced by FlushCoalesce. If zero, the size of the
+	// connection's write buffer is used.
+	FlushSize int
+
+	// MaxPushQueue is the maximum number of the messages pushed or published
+	// to a connection, which are waiting to be written, see Conn.Push and
+	// Publish. If zero, DefaultMaxPushQueue is used.
+	MaxPushQueue int
+
+	// OnPublishDrop specifies an optional callback function that is called,
+	// when a message published is dropped for a subscriber, such as with
+	// ErrPushQueueFull. It is called by the goroutine calling Publish, so
+	// it must not block. The drops are counted by PublishDrops anyway.
+	OnPublishDrop func(topic string, hc *Conn, err error)
+
+	// MaxConns is the maximum number of the connections served at once,
+	// and MaxConnsPerIP is the maximum number of them from the same IP.
+	// The connections exceeding them are rejected at accept time, and
+	// reported by OnReject, and counted by RejectedConns. If zero, there
+	// is no limit.
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// OnReject specifies an optional callback function that is called when
+	// a connection is rejected by MaxConns or MaxConnsPerIP, with the error
+	// ErrMaxConns or ErrMaxConnsPerIP, so the overload can be alerted.
+	// The connection is closed after it returns. The rejections are not
+	// logged, so a flood of them does not flood the ErrorLog.
+	OnReject func(net.Conn, error)
+
+	// AuthTimeout is the maximum duration for a connection to be
+	// authenticated, if the Handler requires it, see Router.Auth.
+	// If zero, there is no timeout.
+	AuthTimeout time.Duration
+
+	// MaxReadFrameSize is the maximum payload size of the frames read
+	// from the clients, it is announced to the clients by SettingMaxFrameSize.
+	// The larger frames are discarded, without closing the connection.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxReadFrameSize uint32
+	// MaxWriteFrameSize is the maximum payload size of the frames written,
+	// it is lowered to the size announced by the client, if any.
+	// The larger responses are split into the continuation frames.
+	// If zero, DefaultMaxFrameSize is used.
+	MaxWriteFrameSize uint32
+	// MaxMessageSize is the maximum size of a request, which is split
+	// into the continuation frames. It is announced to the clients by
+	// SettingMaxMessageSize, the larger requests are discarded, without
+	// closing the connection. If zero, DefaultMaxMessageSize is used.
+	MaxMessageSize uint32
+
+	// Compressor compresses the responses, which are not smaller than
+	// CompressThreshold. It is announced to the clients by SettingCompressor,
+	// and used only with the clients announcing the same one.
+	// If nil, the messages are never compressed.
+	Compressor Compressor
+	// CompressThreshold is the size of the smallest response compressed.
+	// If zero, DefaultCompressThreshold is used.
+	CompressThreshold int
+
+	// Checksum adds a checksum to the frames written, so the corrupted
+	// payloads are detected by the clients. It is used only with the clients
+	// announcing SettingChecksum. The checksums of the frames read are
+	// always verified, if they have one.
+	Checksum bool
+
+	// OnChecksumError specifies an optional callback function that is
+	// called when the checksum of a frame read from the client does not
+	// match. The frame, or the message it belongs to, is discarded.
+	OnChecksumError func(net.Conn, FrameHeader)
+
+	// OnDiscard specifies an optional callback function that is called
+	// when a frame or a message read from the client is discarded, such
+	// as the one exceeding MaxReadFrameSize or MaxMessageSize, or the one
+	// failing the checksum. The call of the stream is failed by the
+	// RST_STREAM frame, or by the GOAWAY frame, if SendGoAwayOnError is set.
+	OnDiscard func(net.Conn, FrameHeader, error)
+
+	// SecureConfig optionally secures the connections accepted by Serve,
+	// see SecureConfig. The clients must use the same config.
+	SecureConfig *SecureConfig
+
+	// SendGoAwayOnError sends the GOAWAY frame with the error code to the
+	// clients, before closing the connections because of the errors, such
+	// as the malformed frames, the messages the codec can not decode, or
+	// the timeouts, see ErrCode. The connections sending the frames or the
+	// messages discarded are closed too, see OnDiscard. The connections rejected by MaxConns and
+	// MaxConnsPerIP are told by ErrCodeRefused.
+	SendGoAwayOnError bool
+
+	// OnConnError specifies an optional callback function that is called
+	// when a connection is closed because of an error, so the bad clients
+	// can be counted and classified. The connections closed by the clients,
+	// or by the server itself, are not reported.
+	OnConnError func(net.Conn, *ConnError)
+
+	// TraceWriter is the writer of the frames traced, see SetTrace.
+	// If nil, DefaultWriter is used.
+	TraceWriter io.Writer
+
+	// TLSConfig optionally provides a TLS configuration for use
+	// by ServeTLS and ListenAndServeTLS. The certificates of the clients
+	// are verified, if its ClientAuth asks for them, and they are
+	// exposed to the handlers by the Request's TLS and PeerCertificate.
+	TLSConfig *tls.Config
+
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state.
 	ConnState func(net.Conn, ConnState)
@@ -55,11 +183,23 @@ type Server struct {
 
 	inShutdown int32 // accessed atomically (non-zero means we're in Shutdown)
 
+	trace   uint32 // accessed atomically, see SetTrace
+	traceMu sync.Mutex
+
 	mu         sync.Mutex
 	listeners  map[*net.Listener]struct{}
 	activeConn map[*conn]struct{}
+	connByID   map[uint64]*conn
+	connsPerIP map[string]int
+	lastConnID uint64 // accessed atomically
+	pubDrops   uint64 // accessed atomically, see PublishDrops
+	rejected   uint64 // accessed atomically, see RejectedConns
+	rejecting  int32  // accessed atomically, see rejectConn
 	doneChan   chan struct{}
 	onShutdown []func()
+
+	topicMu sync.RWMutex
+	topics  topics
 }
 
 func ListenAndServe(addr string, handler Handler, codec Codec) error {
@@ -84,13 +224,60 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve(ln)
 }
 
+// ListenAndServeTLS listens on the TCP network address addr and then calls
+// ServeTLS with handler and codec to handle requests on incoming TLS connections.
+func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler, codec Codec) error {
+	server := &Server{Addr: addr, Handler: handler, Codec: codec}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeTLS acts identically to ListenAndServe, except that it
+// expects TLS connections. The certificate and matching private key
+// are loaded from the files, unless the TLSConfig has any certificates,
+// then the file names may be empty.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	addr := srv.Addr
+	if len(addr) == 0 {
+		return errors.New("empty address")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	return srv.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeTLS accepts incoming connections on the Listener l, and serves them
+// after the TLS handshake, see ListenAndServeTLS for the certificate files.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return srv.Serve(tls.NewListener(l, config))
+}
+
 // Serve the given listener
 func (srv *Server) Serve(l net.Listener) error {
 	l = &onceCloseListener{Listener: l}
 
 	defer func() {
 		if err := l.Close(); err != nil {
-			panic(err)
+			srv.logf("tcp: close listener error: %v", err)
 		}
 	}()
 
@@ -127,7 +314,14 @@ func (srv *Server) Serve(l net.Listener) error {
 			return e
 		}
 		tempDelay = 0
+		if srv.SecureConfig != nil {
+			rw = SecureServer(rw, srv.SecureConfig)
+		}
 		c := srv.newConn(rw)
+		if err := srv.admitConn(c); err != nil {
+			srv.rejectConn(rw, err)
+			continue
+		}
 		c.setState(c.rwc, StateNew) // before Serve can return
 		// do not need context, 'cause the connect is going to connect forever
 		go c.serve()
@@ -187,7 +381,17 @@ func (srv *Server) newConn(rwc net.Conn) *conn {
 	c := &conn{
 		server: srv,
 		rwc:    rwc,
+		id:     srv.nextConnID(),
+
+		connectedAt: time.Now(),
+	}
+	c.handle = &Conn{c: c}
+	// RemoteAddr may block on the Accept goroutine for some net.Conns,
+	// see conn.remoteAddr, so it is called only if the IP is counted
+	if srv.MaxConnsPerIP > 0 {
+		c.remoteIP = remoteIP(rwc)
 	}
+	c.framer.Store(srv.framer())
 	return c
 }
 
@@ -227,13 +431,29 @@ func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
 func (srv *Server) trackConn(c *conn, add bool) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
+	srv.trackConnLocked(c, add)
+}
+
+func (srv *Server) trackConnLocked(c *conn, add bool) {
 	if srv.activeConn == nil {
 		srv.activeConn = make(map[*conn]struct{})
+		srv.connByID = make(map[uint64]*conn)
+		srv.connsPerIP = make(map[string]int)
+	}
+	// the conn admitted is tracked already, see admitConn
+	if _, ok := srv.activeConn[c]; ok == add {
+		return
 	}
 	if add {
 		srv.activeConn[c] = struct{}{}
+		srv.connByID[c.id] = c
+		srv.connsPerIP[c.remoteIP]++
 	} else {
 		delete(srv.activeConn, c)
+		delete(srv.connByID, c.id)
+		if srv.connsPerIP[c.remoteIP]--; srv.connsPerIP[c.remoteIP] <= 0 {
+			delete(srv.connsPerIP, c.remoteIP)
+		}
 	}
 }
 
@@ -254,7 +474,7 @@ func (srv *Server) Close() error {
 	err := srv.closeListenersLocked()
 	for c := range srv.activeConn {
 		_ = c.rwc.Close()
-		delete(srv.activeConn, c)
+		srv.trackConnLocked(c, false)
 	}
 	return err
 }
@@ -287,6 +507,10 @@ var shutdownPollInterval = 500 * time.Millisecond
 // Shutdown returns the context's error, otherwise it returns any
 // error returned from closing the Server's underlying Listener(s).
 //
+// Shutdown sends the GOAWAY frame to all the connections, before waiting
+// for them, so the clients stop starting the new requests on them, see
+// GoAwayError. The responses of the requests already read are still sent.
+//
 // When Shutdown is called, Serve, ListenAndServe, and
 // ListenAndServeTLS immediately return ErrServerClosed. Make sure the
 // program doesn't exit and waits instead for Shutdown to return.
@@ -312,6 +536,9 @@ func (srv *Server) Shutdown() error {
 	}
 	srv.mu.Unlock()
 
+	// tell the clients to reconnect elsewhere
+	srv.goAway(ErrCodeNo)
+
 	ticker := time.NewTicker(shutdownPollInterval)
 	defer ticker.Stop()
 	for {
@@ -351,11 +578,22 @@ func (srv *Server) closeIdleConns() bool {
 		}
 
 		_ = c.rwc.Close()
-		delete(srv.activeConn, c)
+		srv.trackConnLocked(c, false)
 	}
 	return quiescent
 }
 
+// framer returns a Framer with the frame size limits of the server.
+func (srv *Server) framer() *Framer {
+	return &Framer{
+		MaxReadFrameSize:   srv.MaxReadFrameSize,
+		MaxWriteFrameSize:  srv.MaxWriteFrameSize,
+		MaxReadMessageSize: srv.MaxMessageSize,
+		CompressThreshold:  srv.CompressThreshold,
+		Checksum:           srv.Checksum,
+	}
+}
+
 func (srv *Server) idleTimeout() time.Duration {
 	if srv.IdleTimeout != 0 {
 		return srv.IdleTimeout
@@ -381,10 +619,91 @@ const (
 )
 
 // Request wrap the connection and other userful information of the client's request
+//
+// The requests read by the Server are pooled, the Request and its Data
+// are valid only until the handler returns, they are reused by the next
+// requests after it. The handlers retaining the request, such as the ones
+// passing it to another goroutine, must retain a Clone of it instead.
 type Request struct {
 	conn    *conn
 	TypeURL string
 	Data    interface{}
+	// StreamID of the frame which carried the request,
+	// the responses of the request are written with it.
+	StreamID uint32
+
+	// buf is the pooled buffer of the message, which is
+	// returned to the pool along with the request.
+	buf *[]byte
+}
+
+// Clone returns a copy of the request, which is valid after the handler
+// returns. The Data of []byte is copied. The Data of other types may alias
+// the pooled message as well, such as the vectors of FlatbuffersCodec, so
+// it is decoded again by the Server's codec from a copy of the message.
+// The Data of a request not read by the Server is shared by the copy.
+func (req *Request) Clone() *Request {
+	r := &Request{conn: req.conn, TypeURL: req.TypeURL, Data: req.Data, StreamID: req.StreamID}
+	switch data := req.Data.(type) {
+	case []byte:
+		r.Data = append([]byte(nil), data...)
+	default:
+		if req.buf != nil && req.conn != nil {
+			msg := append([]byte(nil), *req.buf...)
+			if err := req.conn.server.Codec.Unmarshal(msg, r); err != nil {
+				// the message was decoded by the same codec already
+				r.Data = req.Data
+			}
+		}
+	}
+	return r
+}
+
+// RTT returns the last round-trip time of the connection measured by
+// the ping frames, or zero if it was never measured. The server measures
+// it only for the clients which ping the server themselves.
+func (req *Request) RTT() time.Duration {
+	if req.conn != nil {
+		return time.Duration(atomic.LoadInt64(&req.conn.rtt))
+	}
+	return 0
+}
+
+// TLS returns the state of the TLS connection, which the request
+// was received on, or nil if the connection is not a TLS one.
+func (req *Request) TLS() *tls.ConnectionState {
+	if req.conn != nil {
+		return req.conn.tlsState
+	}
+	return nil
+}
+
+// PeerCertificate returns the verified certificate of the client,
+// or nil if the client has not presented one. The handlers and the
+// middlewares may authorize the client by its Subject.
+func (req *Request) PeerCertificate() *x509.Certificate {
+	if state := req.TLS(); state != nil && len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[0]
+	}
+	return nil
+}
+
+// Identity returns the common name of the client's certificate,
+// or an empty string if the client has not presented one.
+func (req *Request) Identity() string {
+	if cert := req.PeerCertificate(); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// ProtoVersion returns the protocol version negotiated with the client,
+// see ProtocolVersion.
+func (req *Request) ProtoVersion() uint8 {
+	if req.conn != nil {
+		return req.conn.version
+	}
+	return 0
 }
 
 func (req *Request) RemoteAddr() string {
@@ -410,6 +729,33 @@ type conn struct {
 	// This is the value of a Handler's (*Request).RemoteAddr.
 	remoteAddr string
 
+	// tlsState is the TLS connection state when using TLS.
+	// nil means not TLS.
+	tlsState *tls.ConnectionState
+
+	// version is the protocol version negotiated by the preface,
+	// it is guarded by wmu, until the preface is written.
+	version uint8
+
+	// streamMu guards lastStreamID and goAwaySent, so no request above
+	// the stream id sent by the GOAWAY frame is handled.
+	streamMu sync.Mutex
+	// lastStreamID is the stream id of the last request read,
+	// which is sent by the GOAWAY frame.
+	lastStreamID uint32
+	// goAwaySent is set, if the GOAWAY frame is sent.
+	goAwaySent bool
+	// goAwayPending is set with the code of the GOAWAY frame, which is
+	// sent after the preface, if it was not written yet. Guarded by wmu.
+	goAwayPending bool
+	goAwayCode    ErrCode
+
+	// trace are the trace flags of the connection, which override the
+	// ones of the server, if traceSet is set. Accessed atomically.
+	trace uint32
+	// tracer logs the frames of the connection.
+	tracer *frameTracer
+
 	// werr is set to the first write error to rwc.
 	// It is set via checkConnErrorWriter{w}, where bufw writes.
 	werr error
@@ -420,7 +766,84 @@ type conn struct {
 	// bufw writes to checkConnErrorWriter{c}, which populates werr on error.
 	bufw *bufio.Writer
 
+	// wmu guards bufw, so the frames written by the goroutines other
+	// than the one serving the connection never interleave with the
+	// responses. It is held only while the frames are written, never
+	// while the handlers are running, see connWriter.
+	wmu sync.Mutex
+
+	// id identifies the connection in the Server, and
+	// handle is the Conn of it given to the handlers.
+	id     uint64
+	handle *Conn
+	// remoteIP keys the connections counted by MaxConnsPerIP,
+	// it is empty if MaxConnsPerIP is not set.
+	remoteIP string
+
+	// session keeps the values of the handlers across the requests.
+	session Session
+
+	// auth is the *authState, once the conn is authenticated.
+	// The fields below are set before the requests are read.
+	auth         atomic.Value
+	authRequired bool
+	authTimer    *time.Timer
+
+	// connectedAt is the time the connection was accepted, and the
+	// counters below are accessed atomically, see ConnInfo.
+	connectedAt     time.Time
+	bytesRead       uint64
+	bytesWritten    uint64
+	messagesRead    uint64
+	messagesWritten uint64
+
+	// pushMu guards the messages pushed, which are framed and written
+	// by a goroutine started by Push, see Conn.Push.
+	pushMu     sync.Mutex
+	pushes     [][]byte
+	pushing    bool
+	pushReady  bool
+	pushClosed bool
+
+	// flushPending reports whether the responses coalesced are waiting
+	// for the flushTimer, see FlushCoalesce. Both are guarded by wmu.
+	flushPending bool
+	flushTimer   *time.Timer
+
+	// pingSent is the payload of the unacknowledged ping sent
+	// by the server, which is the unix time in nanoseconds it
+	// was sent. Zero means no ping is sent. Accessed atomically.
+	pingSent int64
+	// rtt is the last round-trip time measured by the ping,
+	// in nanoseconds. Accessed atomically.
+	rtt int64
+
+	// settings are the connSettings announced by the client.
+	settings atomic.Value
+
+	// framer is the *Framer limiting the size of the frames,
+	// it is replaced when the client announces its settings.
+	framer atomic.Value
+
 	curState struct{ atomic uint64 } // packed (unixtime<<8|uint8(ConnState))
+
+	// the fields below are used only if the requests are handled concurrently.
+
+	// sem limits the number of the running requests.
+	sem chan struct{}
+	// outc sends the responses of the finished requests to the writer.
+	outc chan response
+	// writerDone is closed, when the writer exits.
+	writerDone chan struct{}
+	// handlers waits for the running requests.
+	handlers sync.WaitGroup
+	// stateMu guards the fields below, and the transitions
+	// between StateActive and StateIdle.
+	stateMu sync.Mutex
+	// inflight is the number of the requests being read or handled.
+	inflight int
+	// waiting reports whether the conn is waiting for the next request.
+	waiting bool
 }
 
 var stateName = map[ConnState]string{
@@ -447,6 +870,11 @@ func (c *conn) setState(nc net.Conn, state ConnState) {
 	}
 	packedState := uint64(time.Now().Unix()<<8) | uint64(state)
 	atomic.StoreUint64(&c.curState.atomic, packedState)
+	// after the state is stored, so the conn is never subscribed again
+	if state == StateClosed {
+		srv.unsubscribeAll(c)
+		c.session.close()
+	}
 	if hook := srv.ConnState; hook != nil {
 		hook(nc, state)
 	}
@@ -465,6 +893,12 @@ func (c *conn) finalFlush() {
 		c.bufr = nil
 	}
 
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushPending = false
+	}
 	if c.bufw != nil {
 		// flush it, anyway
 		_ = c.bufw.Flush()
@@ -477,6 +911,10 @@ func (c *conn) finalFlush() {
 
 // Close the connection.
 func (c *conn) close() {
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	c.closePushes()
 	c.finalFlush()
 	// close it anyway
 	_ = c.rwc.Close()
@@ -487,8 +925,13 @@ func (c *conn) serve() {
 	// set remote addr
 	c.remoteAddr = c.rwc.RemoteAddr().String()
 
+	c.tracer = c.newTracer()
+	fr := c.server.framer()
+	fr.tracer = c.tracer
+	c.framer.Store(fr)
+
 	defer func() {
-		// recover from reading panic, if failed log the err
+		// recover from the panic of the handler, and log it
 		if err := recover(); err != nil && c.server.shuttingDown() == false {
 			const size = 64 << 10
 			buf := make([]byte, size)
@@ -502,78 +945,510 @@ func (c *conn) serve() {
 		c.setState(c.rwc, StateClosed)
 	}()
 
+	nc := c.rwc
+	if sc, ok := nc.(*SecureConn); ok {
+		nc = sc.Conn
+	}
+	if tlsConn, ok := nc.(*tls.Conn); ok {
+		if d := c.server.ReadTimeout; d != 0 {
+			tlsConn.SetReadDeadline(time.Now().Add(d))
+		}
+		if d := c.server.WriteTimeout; d != 0 {
+			tlsConn.SetWriteDeadline(time.Now().Add(d))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			c.connError("handshake", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		c.tlsState = &state
+	}
+
+	if sc, ok := c.rwc.(*SecureConn); ok {
+		// the HandshakeTimeout of the SecureConfig overrides them, if any
+		if d := c.server.ReadTimeout; d != 0 {
+			sc.SetReadDeadline(time.Now().Add(d))
+		}
+		if d := c.server.WriteTimeout; d != 0 {
+			sc.SetWriteDeadline(time.Now().Add(d))
+		}
+		if err := sc.Handshake(); err != nil {
+			c.connError("handshake", err)
+			return
+		}
+		sc.SetDeadline(time.Time{})
+	}
+
 	// wrap the underline conn with bufio reader&writer
 	// sync pool inside
-	c.bufr = newBufioReader(c.rwc)
-	c.bufw = newBufioWriter(c.rwc)
+	c.bufr = newBufioReader(countReader{c})
+	c.bufw = newBufioWriter(countWriter{c})
+
+	if err := c.servePreface(); err != nil {
+		c.connError("preface", err)
+		return
+	}
+	c.startPushes()
+	c.startAuth()
+
+	if n := c.server.MaxConcurrentRequests; n > 1 {
+		c.startWriter(n)
+		// wait for the handlers and the writer, before closing the conn
+		defer c.stopWriter()
+	}
 
 	// conn loop start
 	for {
+		if c.outc != nil {
+			if err := c.waitRequest(); err != nil {
+				return
+			}
+		}
+
 		// handle connection timeout
 		if d := c.server.ReadTimeout; d != 0 {
 			c.rwc.SetReadDeadline(time.Now().Add(d))
 		}
 		// read frame header
-		fh, err := ReadFrameHeader(c.bufr)
+		fh, err := c.getFramer().ReadFrameHeader(c.bufr)
 		// log.Print(fh)
-		// it's ok to continue, when reached the EOF
-		if err != nil && err != io.EOF {
-			// TODO: log error instead?
-			panic(err)
+		// the peer closed the connection
+		if err == io.EOF {
+			return
+		}
+		// skip the oversize frame, the framing is still intact
+		if errors.Is(err, ErrFrameTooLarge) {
+			if err := skipFramePayload(c.bufr, fh); err != nil {
+				return
+			}
+			if !c.discardMessage(fh, err) {
+				return
+			}
+			if c.outc == nil && !c.waitIdle() {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			c.connError("read", err)
+			return
 		}
 
-		// set underline conn to active mode
-		c.setState(c.rwc, StateActive)
+		// the control frames are handled by the connection itself,
+		// they do not change the state of the connection
+		if fh.Type != FrameData {
+			if err := c.processFrame(fh); isMessageError(err) {
+				if !c.discardMessage(fh, err) {
+					return
+				}
+			} else if err != nil {
+				c.connError("read", err)
+				return
+			}
+			if c.outc == nil && !c.waitIdle() {
+				return
+			}
+			continue
+		}
 
-		if fh.Length > 0 {
-			req, err := ReadFrameBody(c.bufr, fh, c.server.Codec)
-			// it's ok to continue, when reached the EOF
-			if err != nil && err != io.EOF {
-				// TODO: log error instead?
-				panic(err)
+		// the requests above the stream id sent by the GOAWAY frame are
+		// never handled, the client retries them on another connection
+		if !c.acceptStream(fh.StreamID) {
+			if err := c.skipMessage(fh); err != nil {
+				c.connError("read", err)
+				return
+			}
+			if c.outc == nil && !c.waitIdle() {
+				return
 			}
+			continue
+		}
 
-			if req != nil {
-				req.conn = c
-				// handle the message to router
-				w := NewResponseWriter(c.bufw, c.server.Codec)
+		// set underline conn to active mode
+		if c.outc != nil {
+			c.beginRequest()
+		} else {
+			c.setState(c.rwc, StateActive)
+		}
 
-				if c.server.Handler != nil {
-					c.server.Handler.ServeProto(w, req)
+		if fh.Length > 0 || fh.Flags.Has(FlagDataContinued) {
+			req, err := c.readRequest(fh)
+			// the peer closed the connection
+			if err == io.EOF {
+				return
+			}
+			// the frames of the oversize or the corrupted request are discarded
+			if isMessageError(err) {
+				if !c.discardMessage(fh, err) {
+					return
 				}
+			} else if err != nil {
+				c.connError("read", err)
+				return
+			}
 
-				// flush bufw, if any
-				// TODO: validation?
-				if w.Buffered() > 0 {
-					if d := c.server.WriteTimeout; d != 0 {
-						c.rwc.SetWriteDeadline(time.Now().Add(d))
-					}
+			if req != nil {
+				req.conn = c
 
-					if err := w.Flush(); err != nil {
-						panic(err)
+				if c.outc != nil {
+					// pause reading, while too many requests are running
+					c.sem <- struct{}{}
+					auth := c.needsAuth()
+					c.goServe(req)
+					if auth {
+						// the messages are handled one at a time, until authenticated
+						c.handlers.Wait()
+						if c.authFailed() {
+							return
+						}
 					}
+					continue
 				}
 
 				// if the writer require close, then return and close the conn
-				if !w.KeepAlive() {
+				keepAlive := c.serveRequest(req)
+				putRequest(req)
+				if !keepAlive || c.authFailed() {
 					return
 				}
 			}
 		}
 
+		if c.outc != nil {
+			c.finishRequest()
+			continue
+		}
+
 		// set rwc to idle state again
 		c.setState(c.rwc, StateIdle)
-		// handle connection idle
-		if d := c.server.idleTimeout(); d != 0 {
-			c.rwc.SetReadDeadline(time.Now().Add(d))
-			if _, err := c.bufr.Peek(4); err != nil {
-				return
-			}
+		if !c.waitIdle() {
+			return
 		}
+	}
+}
+
+// waitIdle waits for the next frame, if the idle timeout is set.
+// It returns false, if the connection should be closed.
+func (c *conn) waitIdle() bool {
+	// handle connection idle
+	if d := c.server.idleTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+		if _, err := c.bufr.Peek(4); err != nil {
+			c.connError("read", err)
+			return false
+		}
+	}
+	c.rwc.SetReadDeadline(time.Time{})
+	return true
+}
+
+func (c *conn) getFramer() *Framer {
+	return c.framer.Load().(*Framer)
+}
+
+// readRequest reads the message of the data frame into a pooled request,
+// which is returned to the pool by putRequest, after the handler returns.
+func (c *conn) readRequest(fh FrameHeader) (*Request, error) {
+	buf, err := c.getFramer().readMessage(c.bufr, fh)
+	if err != nil {
+		return nil, err
+	}
+
+	req := getRequest()
+	req.StreamID = fh.StreamID
+	req.buf = buf
+	if err := c.server.Codec.Unmarshal(*buf, req); err != nil {
+		putRequest(req)
+		return nil, &CodecError{Err: err}
+	}
+	atomic.AddUint64(&c.messagesRead, 1)
+	return req, nil
+}
+
+// skipMessage reads the frames of the message, and drops them.
+func (c *conn) skipMessage(fh FrameHeader) error {
+	buf, err := c.getFramer().readMessage(c.bufr, fh)
+	if isMessageError(err) {
+		return nil
+	}
+	putBuffer(buf)
+	return err
+}
+
+// discardMessage reports the frame or the message discarded for the error,
+// and fails the call of the stream, so the client is not left waiting.
+// It returns false, if the connection should be closed.
+func (c *conn) discardMessage(fh FrameHeader, err error) bool {
+	c.server.logf("tcp: discard %v frame from %v: %v", fh.Type, c.remoteAddr, err)
+	if hook := c.server.OnChecksumError; hook != nil && err == ErrChecksum {
+		hook(c.rwc, fh)
+	}
+	if hook := c.server.OnDiscard; hook != nil {
+		hook(c.rwc, fh, err)
+	}
+
+	// the GOAWAY frame, or closing the connection, fails the call
+	if c.server.SendGoAwayOnError {
+		c.connError("read", err)
+		return false
+	}
+	if fh.StreamID == 0 {
+		return true
+	}
+	if err := c.resetStream(fh.StreamID, errCode(err)); err != nil {
+		c.connError("write", err)
+		return false
+	}
+	return true
+}
+
+// processFrame handles the control frame.
+func (c *conn) processFrame(fh FrameHeader) error {
+	// the control frames are processed synchronously,
+	// so the payload is returned to the pool after it
+	buf := getBuffer(int(fh.Length))
+	defer putBuffer(buf)
+	payload := *buf
+	if err := readPayload(c.bufr, fh, payload); err != nil {
+		return err
+	}
+	c.tracer.trace(TraceReads, fh, payload)
+
+	switch fh.Type {
+	case FramePing:
+		return c.processPing(fh, payload)
+	case FrameSettings:
+		return c.processSettings(fh, payload)
+	}
+	// ignore the unknown frames
+	return nil
+}
+
+// serveRequest handles the request, and flushes the responses of it.
+// It returns false, if the connection should be closed.
+func (c *conn) serveRequest(req *Request) bool {
+	// the responses are framed into bufw directly, wmu is held only
+	// while each of them is written, not while the handler is running
+	w := getResponseWriter(connWriter{c}, c.server.Codec, req.StreamID, c.getFramer())
+	w.conn = c
+	w.flushEach = c.server.FlushPolicy == FlushPerMessage
+	defer putResponseWriter(w)
+
+	// handle the message to router
+	if c.server.Handler != nil {
+		c.server.Handler.ServeProto(w, req)
+	}
+
+	// flush bufw by the flush policy
+	c.wmu.Lock()
+	err := c.flushResponsesLocked(w.KeepAlive())
+	c.wmu.Unlock()
+	if err != nil {
+		c.connError("write", err)
+		return false
+	}
+
+	return w.KeepAlive()
+}
+
+// CONCURRENT REQUESTS -----------------------------------
+
+// response is the buffered responses of a finished request,
+// waiting to be written by the connection's writer.
+type response struct {
+	buf       *responseBuffer
+	keepAlive bool
+}
+
+// responseBuffer buffers the responses of a request, which is
+// handled concurrently. It is flushed by the connection's writer
+// once the handler returns.
+type responseBuffer struct {
+	bytes.Buffer
+	conn *conn
+}
+
+// Buffered returns the number of bytes written into the buffer.
+func (rb *responseBuffer) Buffered() int {
+	return rb.Len()
+}
+
+// Flush writes the responses buffered to the connection immediately,
+// ahead of the ones of the requests finished before.
+func (rb *responseBuffer) Flush() error {
+	if rb.Len() == 0 {
+		return nil
+	}
+
+	c := rb.conn
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.bufw == nil {
+		return net.ErrClosed
+	}
+	if _, err := c.bufw.Write(rb.Bytes()); err != nil {
+		return err
+	}
+	rb.Reset()
+	return c.flushLocked()
+}
+
+var responseBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(responseBuffer)
+	},
+}
+
+// maxPooledResponseBuffer is the capacity of the largest responseBuffer
+// pooled, so a large response never pins its buffer in the pool.
+const maxPooledResponseBuffer = 64 << 10
+
+func putResponseBuffer(rb *responseBuffer) {
+	if rb.Cap() > maxPooledResponseBuffer {
+		return
+	}
+	rb.Reset()
+	rb.conn = nil
+	responseBufferPool.Put(rb)
+}
+
+// startWriter starts the writer goroutine of the connection,
+// and allows n requests to be handled concurrently.
+func (c *conn) startWriter(n int) {
+	c.sem = make(chan struct{}, n)
+	c.outc = make(chan response, n)
+	c.writerDone = make(chan struct{})
+	go c.writeLoop()
+}
+
+// stopWriter waits for all the running handlers, and for
+// their responses to be written.
+func (c *conn) stopWriter() {
+	c.handlers.Wait()
+	close(c.outc)
+	<-c.writerDone
+}
+
+// waitRequest waits for the next request. The idle timeout is
+// applied only if there is no running request.
+func (c *conn) waitRequest() error {
+	c.stateMu.Lock()
+	c.waiting = true
+	c.setIdleDeadlineLocked()
+	c.stateMu.Unlock()
+
+	_, err := c.bufr.Peek(1)
+
+	c.stateMu.Lock()
+	c.waiting = false
+	c.stateMu.Unlock()
+	c.rwc.SetReadDeadline(time.Time{})
+	return err
+}
+
+func (c *conn) setIdleDeadlineLocked() {
+	if !c.waiting {
+		return
+	}
+	if d := c.server.idleTimeout(); d != 0 && c.inflight == 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	} else {
 		c.rwc.SetReadDeadline(time.Time{})
 	}
 }
 
+// beginRequest sets the connection to active, when the
+// first request is read.
+func (c *conn) beginRequest() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.inflight++
+	if c.inflight == 1 {
+		c.setState(c.rwc, StateActive)
+	}
+}
+
+// finishRequest sets the connection to idle, when the last
+// running request is finished.
+func (c *conn) finishRequest() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.inflight--
+	if c.inflight == 0 {
+		c.setState(c.rwc, StateIdle)
+		c.setIdleDeadlineLocked()
+	}
+}
+
+// goServe handles the request in a new goroutine.
+func (c *conn) goServe(req *Request) {
+	c.handlers.Add(1)
+	go func() {
+		buf := responseBufferPool.Get().(*responseBuffer)
+		buf.conn = c
+		w := getResponseWriter(buf, c.server.Codec, req.StreamID, c.getFramer())
+		w.conn = c
+		w.flushEach = c.server.FlushPolicy == FlushPerMessage
+
+		defer func() {
+			if err := recover(); err != nil {
+				const size = 64 << 10
+				stack := make([]byte, size)
+				stack = stack[:runtime.Stack(stack, false)]
+				c.server.logf("tcp: panic serving %v: %v\n%s", c.remoteAddr, err, stack)
+				// the responses of the request can not be trusted anymore
+				buf.Reset()
+				w.SetKeepAlive(false)
+			}
+			c.outc <- response{buf: buf, keepAlive: w.KeepAlive()}
+			putResponseWriter(w)
+			putRequest(req)
+			<-c.sem
+			c.finishRequest()
+			c.handlers.Done()
+		}()
+
+		if c.server.Handler != nil {
+			c.server.Handler.ServeProto(w, req)
+		}
+	}()
+}
+
+// writeLoop writes the responses of the finished requests, the writer is
+// flushed, when there is no more response waiting to be written.
+func (c *conn) writeLoop() {
+	defer close(c.writerDone)
+
+	closing := false
+	for res := range c.outc {
+		if !closing && res.buf.Len() > 0 {
+			c.wmu.Lock()
+			if d := c.server.WriteTimeout; d != 0 {
+				c.rwc.SetWriteDeadline(time.Now().Add(d))
+			}
+			_, err := c.bufw.Write(res.buf.Bytes())
+			if err == nil && (len(c.outc) == 0 || !res.keepAlive) {
+				err = c.flushResponsesLocked(res.keepAlive)
+			}
+			c.wmu.Unlock()
+			if err != nil {
+				c.connError("write", err)
+				closing = true
+				c.rwc.Close()
+			}
+		}
+
+		putResponseBuffer(res.buf)
+
+		// if the writer require close, drop the rest of the responses
+		if !closing && !res.keepAlive {
+			closing = true
+			c.rwc.Close()
+		}
+	}
+}
+
 // FRAME -------------------------------------------------
 
 // A FrameType is a registered frame type as defined in
@@ -582,6 +1457,10 @@ type FrameType uint8
 
 const frameHeaderLen = 5
 
+// streamIDLen is the length of the optional stream id,
+// which follows the frame header, if FlagFrameStream is set.
+const streamIDLen = 4
+
 const (
 	// FrameData type
 	FrameData FrameType = 0x0
@@ -589,12 +1468,24 @@ const (
 	FrameSettings FrameType = 0x1
 	// FramePing type
 	FramePing FrameType = 0x2
+	// FrameContinuation type, which carries the rest of a message
+	// started by a DATA frame.
+	FrameContinuation FrameType = 0x3
+	// FrameGoAway type, which tells the peer to stop starting the new
+	// requests on the connection, see GoAwayError.
+	FrameGoAway FrameType = 0x4
+	// FrameRSTStream type, which tells the peer the message of the stream
+	// is discarded, see StreamError.
+	FrameRSTStream FrameType = 0x5
 )
 
 var frameName = map[FrameType]string{
-	FrameData:     "DATA",
-	FrameSettings: "SETTINGS",
-	FramePing:     "PING",
+	FrameData:         "DATA",
+	FrameSettings:     "SETTINGS",
+	FramePing:         "PING",
+	FrameContinuation: "CONTINUATION",
+	FrameGoAway:       "GOAWAY",
+	FrameRSTStream:    "RST_STREAM",
 }
 
 func (t FrameType) String() string {
@@ -605,8 +1496,12 @@ func (t FrameType) String() string {
 }
 
 const (
-	minMaxFrameSize = 1 << 14
-	maxFrameSize    = 4096 - 1
+	// DefaultMaxFrameSize is the maximum frame payload size read and
+	// written, when the limits are not set on the Server or the Dialer.
+	DefaultMaxFrameSize = 1 << 14
+	// maxFrameSize is the largest frame payload size the header
+	// can carry, which is one byte less than 16MB (uint24).
+	maxFrameSize = 1<<24 - 1
 )
 
 // Flags is a bitmask of HTTP/2 flags.
@@ -622,25 +1517,42 @@ func (f Flags) Has(v Flags) bool {
 const (
 	// check flag for validating the frame
 	FlagFrameAck Flags = 0x10
+	// the frame header is followed by a 4 bytes stream id,
+	// which correlates the responses with the request
+	FlagFrameStream Flags = 0x20
 
 	// Data Frame
 	// FlagDataEndStream Flags = 0x10
+	// the message continues in the next CONTINUATION frame,
+	// it is set on the DATA and the CONTINUATION frames.
+	FlagDataContinued Flags = 0x4
+	// the message is compressed by the negotiated Compressor,
+	// it is set on the DATA frame only.
+	FlagDataCompressed Flags = 0x40
+	// the payload is followed by a 4 bytes CRC-32C checksum of it,
+	// which is not counted in the length of the frame
+	FlagFrameChecksum Flags = 0x80
 
 	// Settings Frame
-	// FlagSettingsAck Flags = 0x10
+	FlagSettingsAck Flags = 0x1
 
 	// Ping Frame
-	// FlagPingAck Flags = 0x10
+	FlagPingAck Flags = 0x1
 )
 
 // ErrFrameTooLarge is returned from Framer.ReadFrame when the peer
-// sends a frame that is larger than declared with SetMaxReadFrameSize.
+// sends a frame that is larger than declared with MaxReadFrameSize,
+// or when a control frame larger than MaxWriteFrameSize is written.
+// The errors returned are of type *FrameTooLargeError, which matches
+// ErrFrameTooLarge with errors.Is.
 var ErrFrameTooLarge = errors.New("tcp: frame too large")
 
 // ErrFrameFlags is returned from ReadFrame when Flags.has returned false
 var ErrFrameFlags = errors.New("tcp: frame flags error")
 
-var logReads, logWrites bool
+// ErrFrameSize is returned when the length of a control frame
+// is invalid for its type.
+var ErrFrameSize = errors.New("tcp: frame size error")
 
 // FrameHeader store the reading data header
 type FrameHeader struct {
@@ -649,18 +1561,18 @@ type FrameHeader struct {
 	// Flags are the 1 byte of 8 potential bit flags per frame.
 	// They are specific to the frame type.
 	Flags Flags
-	// Length is the length of the frame, not including the 9 byte header.
+	// Length is the length of the frame, not including the 5 byte header,
+	// the stream id and the checksum.
 	// The maximum size is one byte less than 16MB (uint24), but only
-	// frames up to 16KB are allowed without peer agreement.
+	// frames up to 16KB are allowed without peer agreement,
+	// see SettingMaxFrameSize.
 	Length uint32
+	// StreamID is the stream id of the frame, if FlagFrameStream is set.
+	// Zero means the frame does not belong to any stream.
+	StreamID uint32
 }
 
 func (fh *FrameHeader) validate() error {
-	// frame body size check
-	if fh.Length > maxFrameSize {
-		return ErrFrameTooLarge
-	}
-
 	// frameack flag check for validating the data
 	if fh.Flags.Has(FlagFrameAck) == false {
 		return ErrFrameFlags
@@ -674,56 +1586,18 @@ func (fh *FrameHeader) validate() error {
 
 // ReadFrameHeader from the io reader.
 func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
-	pbuf := fhBytes.Get().(*[]byte)
-	defer fhBytes.Put(pbuf)
-
-	buf := *(pbuf)
-	_, err := io.ReadFull(r, buf[:frameHeaderLen])
-
-	if err != nil {
-		return FrameHeader{}, err
-	}
-
-	fh := FrameHeader{
-		Length: (uint32(buf[0])<<16 | uint32(buf[1])<<8 | uint32(buf[2])),
-		Type:   FrameType(buf[3]),
-		Flags:  Flags(buf[4]),
-	}
-
-	err = fh.validate()
-	return fh, err
+	return defaultFramer.ReadFrameHeader(r)
 }
 
 // ReadFrameBody from the io reader and frame header
 // it will return a request if succeed
 func ReadFrameBody(r io.Reader, fh FrameHeader, codec Codec) (req *Request, err error) {
-	// read frame body
-	// TODO: byte array pooling?
-	fb := make([]byte, fh.Length)
-	_, err = io.ReadFull(r, fb)
-
-	if err != nil {
-		return nil, err
-	}
-
-	req = &Request{}
-	err = codec.Unmarshal(fb, req)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return
+	return defaultFramer.ReadFrameBody(r, fh, codec)
 }
 
 // ... for test only
 func ReadFrame(r io.Reader, codec Codec) (*Request, error) {
-	fh, err := ReadFrameHeader(r)
-	if err != nil {
-		return nil, err
-	}
-
-	return ReadFrameBody(r, fh, codec)
+	return defaultFramer.ReadFrame(r, codec)
 }
 
 // frame header bytes pool.
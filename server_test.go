@@ -2,8 +2,21 @@ package gotham
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -86,6 +99,7 @@ func TestServe(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	exchangePreface(t, conn)
 
 	w := bufio.NewWriter(conn)
 	msg := &pb.Ping{
@@ -137,6 +151,7 @@ func TestReadWriteData(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	exchangePreface(t, conn)
 
 	ping := &pb.Ping{
 		Message: "Ping",
@@ -206,7 +221,7 @@ func TestReadWriteData(t *testing.T) {
 	w.Flush()
 	// then wait a little while, write the left...
 	time.Sleep(time.Millisecond * 5)
-	wbuf = append(payload[3:])
+	wbuf = payload[3:]
 	w.Write(wbuf)
 	w.Flush()
 	time.Sleep(time.Millisecond * 5)
@@ -227,6 +242,7 @@ func TestWriteFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	exchangePreface(t, conn)
 
 	w := newBufioWriter(conn)
 	r := newBufioReader(conn)
@@ -254,6 +270,41 @@ func TestWriteFrame(t *testing.T) {
 	assert.Equal(t, "Pong", pong.GetMessage())
 }
 
+func TestStreamFrame(t *testing.T) {
+	addr := ":9000"
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	// connect to server
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	payload, _ := (&ProtobufCodec{}).Marshal(&pb.Ping{Message: "Ping"})
+	writeData(w, 7, payload)
+	WriteData(w, payload)
+	writeData(w, 1<<24+1, payload)
+	w.Flush()
+
+	// the responses carry the stream id of the requests
+	res, err := ReadFrame(r, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), res.StreamID)
+	res, err = ReadFrame(r, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), res.StreamID)
+	res, err = ReadFrame(r, &ProtobufCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1<<24+1), res.StreamID)
+}
+
 func TestErrorFrame(t *testing.T) {
 	addr := ":9000"
 	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
@@ -266,6 +317,7 @@ func TestErrorFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	exchangePreface(t, conn)
 
 	w := newBufioWriter(conn)
 	r := newBufioReader(conn)
@@ -331,6 +383,7 @@ func TestServerKCP(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	exchangePreface(t, conn)
 
 	t.Log("kcp connected")
 
@@ -370,3 +423,272 @@ func TestServerKCP(t *testing.T) {
 
 	time.Sleep(time.Millisecond * 5)
 }
+
+type tSlowHandler struct {
+	tHandler
+}
+
+func (sh *tSlowHandler) ServeProto(w ResponseWriter, req *Request) {
+	if req.TypeURL == "pb.Error" {
+		time.Sleep(time.Millisecond * 50)
+	}
+	if req.TypeURL == "pb.Ping" {
+		var ping pb.Ping
+		proto.Unmarshal(req.Data.([]byte), &ping)
+		if ping.GetMessage() == "Slow" {
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+	sh.tHandler.ServeProto(w, req)
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	addr := ":9000"
+	server := &Server{Addr: addr, Handler: &tSlowHandler{}, Codec: &ProtobufCodec{}}
+	server.MaxConcurrentRequests = 4
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	// connect to server
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+	codec := &ProtobufCodec{}
+
+	slow, _ := codec.Marshal(&pb.Error{Code: 400, Message: "Ping Error"})
+	fast, _ := codec.Marshal(&pb.Ping{Message: "Ping"})
+	writeData(w, 1, slow)
+	writeData(w, 2, fast)
+	writeData(w, 3, fast)
+	w.Flush()
+
+	// the fast requests are not blocked by the slow one
+	res, err := ReadFrame(r, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+	res, err = ReadFrame(r, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+
+	server.mu.Lock()
+	for c := range server.activeConn {
+		st, _ := c.getState()
+		assert.Equal(t, StateActive, st)
+	}
+	server.mu.Unlock()
+
+	res, err = ReadFrame(r, codec)
+	assert.NoError(t, err)
+	assert.Equal(t, "pb.Error", res.TypeURL)
+	assert.Equal(t, uint32(1), res.StreamID)
+
+	// the slow request closed the connection
+	time.Sleep(time.Millisecond * 5)
+	server.mu.Lock()
+	assert.Equal(t, 0, len(server.activeConn))
+	server.mu.Unlock()
+}
+
+func TestConcurrentRequestsLimit(t *testing.T) {
+	addr := ":9000"
+	server := &Server{Addr: addr, Handler: &tSlowHandler{}, Codec: &ProtobufCodec{}}
+	server.MaxConcurrentRequests = 2
+	server.IdleTimeout = time.Millisecond * 20
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	// connect to server
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+	codec := &ProtobufCodec{}
+
+	slow, _ := codec.Marshal(&pb.Ping{Message: "Slow"})
+	for i := 0; i < 3; i++ {
+		writeData(w, uint32(i+1), slow)
+	}
+	w.Flush()
+
+	// only two requests are handled at once, and the idle timeout
+	// does not close the conn while the handlers are busy
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := ReadFrame(r, codec)
+		assert.NoError(t, err)
+		assert.Equal(t, "pb.Ping", res.TypeURL)
+	}
+	assert.True(t, time.Since(start) >= time.Millisecond*90)
+
+	// the conn is closed after the idle timeout
+	time.Sleep(time.Millisecond * 50)
+	server.mu.Lock()
+	assert.Equal(t, 0, len(server.activeConn))
+	server.mu.Unlock()
+}
+
+func TestConcurrentRequestsPanic(t *testing.T) {
+	addr := ":9000"
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	server.MaxConcurrentRequests = 2
+	server.ErrorLog = log.New(ioutil.Discard, "", 0)
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	// connect to server
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	// the handler panics on unknown urls, the conn is closed
+	w := newBufioWriter(conn)
+	payload, _ := (&ProtobufCodec{}).Marshal(&pb.Ping{Message: "Ping"})
+	any := &any.Any{}
+	proto.Unmarshal(payload, any)
+	any.TypeUrl = "pb.Unknown"
+	payload, _ = proto.Marshal(any)
+	writeData(w, 1, payload)
+	w.Flush()
+
+	_, err = ReadFrame(conn, &ProtobufCodec{})
+	assert.Equal(t, io.EOF, err)
+}
+
+// newTestCert returns a certificate signed by the parent, or a self-signed
+// one if the parent is nil, and the PEM encoded certificate and key.
+func newTestCert(t *testing.T, name string, parent *tls.Certificate) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert, certPEM, keyPEM
+}
+
+func TestServerTLS(t *testing.T) {
+	ca, _, _ := newTestCert(t, "gotham ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	_, certPEM, keyPEM := newTestCert(t, "gotham", &ca)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+	clientCert, _, _ := newTestCert(t, "batman", &ca)
+
+	addr := "127.0.0.1:9000"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		assert.NotNil(t, c.Request.TLS())
+		c.Write(&pb.Ping{Message: c.Request.Identity()})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.TLSConfig = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+
+	// the certificate files are required
+	assert.Error(t, server.ListenAndServeTLS("", ""))
+
+	go server.ListenAndServeTLS(certFile, keyFile)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 5)
+
+	// the client authorized by its certificate
+	client, err := (&Dialer{
+		Codec:     &ProtobufCodec{},
+		TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}},
+	}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, "batman", readPingMessage(res))
+	client.Close()
+
+	// the client without a certificate is anonymous
+	client, err = (&Dialer{
+		Codec:     &ProtobufCodec{},
+		TLSConfig: &tls.Config{RootCAs: pool},
+	}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, "", readPingMessage(res))
+	client.Close()
+
+	// the server is not trusted by the client
+	_, err = (&Dialer{Codec: &ProtobufCodec{}, TLSConfig: &tls.Config{}}).Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// the certificate is required, and signed by the ca
+	server.Close()
+	server = &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.TLSConfig = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	go server.ListenAndServeTLS(certFile, keyFile)
+	defer server.Close()
+	time.Sleep(time.Millisecond * 5)
+
+	other, _, _ := newTestCert(t, "joker", nil)
+	for _, certs := range [][]tls.Certificate{nil, {other}} {
+		client, err = (&Dialer{
+			Codec:     &ProtobufCodec{},
+			TLSConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+		}).Dial("tcp", addr)
+		if err == nil {
+			// the client may finish the handshake before the server rejects it
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err = client.Call(ctx, &pb.Ping{Message: "Ping"}, &res)
+			cancel()
+			client.Close()
+		}
+		assert.Error(t, err)
+	}
+}
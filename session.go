@@ -0,0 +1,171 @@
+package gotham
+
+import (
+	"sync"
+	"time"
+)
+
+// Session is a key/value store of a connection, which survives across
+// the requests, unlike the Keys of the Context. It is safe for concurrent
+// use, the handlers of the requests handled concurrently, and the other
+// goroutines holding the Conn may access it at the same time.
+//
+// The session is cleared, when the connection is closed, after the
+// callbacks registered by OnClose are called.
+type Session struct {
+	mu      sync.RWMutex
+	keys    map[string]interface{}
+	onClose []func(*Session)
+	closed  bool
+}
+
+// Set stores a new key/value pair in the session. It does nothing,
+// after the connection is closed.
+func (s *Session) Set(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.keys == nil {
+		s.keys = make(map[string]interface{})
+	}
+	s.keys[key] = value
+}
+
+// Get returns the value for the given key, ie: (value, true).
+// If the value does not exists it returns (nil, false)
+func (s *Session) Get(key string) (value interface{}, exists bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, exists = s.keys[key]
+	return
+}
+
+// MustGet returns the value for the given key if it exists, otherwise it panics.
+func (s *Session) MustGet(key string) interface{} {
+	if value, exists := s.Get(key); exists {
+		return value
+	}
+	panic("Key \"" + key + "\" does not exist")
+}
+
+// Delete removes the value for the given key.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
+
+// GetString returns the value associated with the key as a string.
+func (s *Session) GetString(key string) (str string) {
+	if val, ok := s.Get(key); ok && val != nil {
+		str, _ = val.(string)
+	}
+	return
+}
+
+// GetBool returns the value associated with the key as a boolean.
+func (s *Session) GetBool(key string) (b bool) {
+	if val, ok := s.Get(key); ok && val != nil {
+		b, _ = val.(bool)
+	}
+	return
+}
+
+// GetInt returns the value associated with the key as an integer.
+func (s *Session) GetInt(key string) (i int) {
+	if val, ok := s.Get(key); ok && val != nil {
+		i, _ = val.(int)
+	}
+	return
+}
+
+// GetInt64 returns the value associated with the key as an integer.
+func (s *Session) GetInt64(key string) (i64 int64) {
+	if val, ok := s.Get(key); ok && val != nil {
+		i64, _ = val.(int64)
+	}
+	return
+}
+
+// GetUint64 returns the value associated with the key as an unsigned integer.
+func (s *Session) GetUint64(key string) (u64 uint64) {
+	if val, ok := s.Get(key); ok && val != nil {
+		u64, _ = val.(uint64)
+	}
+	return
+}
+
+// GetFloat64 returns the value associated with the key as a float64.
+func (s *Session) GetFloat64(key string) (f64 float64) {
+	if val, ok := s.Get(key); ok && val != nil {
+		f64, _ = val.(float64)
+	}
+	return
+}
+
+// GetTime returns the value associated with the key as time.
+func (s *Session) GetTime(key string) (t time.Time) {
+	if val, ok := s.Get(key); ok && val != nil {
+		t, _ = val.(time.Time)
+	}
+	return
+}
+
+// GetDuration returns the value associated with the key as a duration.
+func (s *Session) GetDuration(key string) (d time.Duration) {
+	if val, ok := s.Get(key); ok && val != nil {
+		d, _ = val.(time.Duration)
+	}
+	return
+}
+
+// OnClose registers a callback, which is called when the connection is
+// closed, before the session is cleared, so it may read the values to
+// clean up. It is called at once, if the connection is closed already.
+func (s *Session) OnClose(f func(*Session)) {
+	s.mu.Lock()
+	if !s.closed {
+		s.onClose = append(s.onClose, f)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	f(s)
+}
+
+// close calls the callbacks registered by OnClose, and clears the session.
+func (s *Session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	callbacks := s.onClose
+	s.onClose = nil
+	s.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(s)
+	}
+
+	s.mu.Lock()
+	s.keys = nil
+	s.mu.Unlock()
+}
+
+// Session returns the session of the connection.
+func (hc *Conn) Session() *Session {
+	return &hc.c.session
+}
+
+// Session returns the session of the connection the request was read
+// from, which keeps the values across the requests, see Session.
+func (c *Context) Session() *Session {
+	if hc := c.Conn(); hc != nil {
+		return hc.Session()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gotham
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	var s Session
+	_, ok := s.Get("player")
+	assert.False(t, ok)
+	assert.Panics(t, func() { s.MustGet("player") })
+
+	s.Set("player", "bruce")
+	s.Set("level", 3)
+	s.Set("id", uint64(42))
+	s.Set("online", time.Second)
+	assert.Equal(t, "bruce", s.MustGet("player"))
+	assert.Equal(t, "bruce", s.GetString("player"))
+	assert.Equal(t, 3, s.GetInt("level"))
+	assert.Equal(t, uint64(42), s.GetUint64("id"))
+	assert.Equal(t, time.Second, s.GetDuration("online"))
+	assert.Equal(t, "", s.GetString("level"))
+	s.Delete("level")
+	assert.Equal(t, 0, s.GetInt("level"))
+
+	// the callbacks read the values, before they are cleared
+	var closed []string
+	s.OnClose(func(s *Session) { closed = append(closed, s.GetString("player")) })
+	s.close()
+	s.close()
+	assert.Equal(t, []string{"bruce"}, closed)
+	_, ok = s.Get("player")
+	assert.False(t, ok)
+
+	// nothing is stored after it is closed
+	s.Set("player", "bruce")
+	_, ok = s.Get("player")
+	assert.False(t, ok)
+	s.OnClose(func(s *Session) { closed = append(closed, "late") })
+	assert.Equal(t, []string{"bruce", "late"}, closed)
+}
+
+func TestServerSession(t *testing.T) {
+	addr := "127.0.0.1:9014"
+	closed := make(chan string, 1)
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		var msg pb.Ping
+		proto.Unmarshal(c.Request.Data.([]byte), &msg)
+
+		s := c.Session()
+		if s.GetString("player") == "" {
+			s.Set("player", msg.Message)
+			s.OnClose(func(s *Session) { closed <- s.GetString("player") })
+		}
+		c.Write(&pb.Ping{Message: s.GetString("player")})
+	})
+
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	call := func(message string) string {
+		var res Request
+		assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: message}, &res))
+		var msg pb.Ping
+		assert.NoError(t, proto.Unmarshal(res.Data.([]byte), &msg))
+		return msg.Message
+	}
+
+	// the session is kept across the requests
+	assert.Equal(t, "bruce", call("bruce"))
+	assert.Equal(t, "bruce", call("alfred"))
+
+	client.Close()
+	select {
+	case player := <-closed:
+		assert.Equal(t, "bruce", player)
+	case <-time.After(time.Second):
+		t.Fatal("the session is not closed")
+	}
+}
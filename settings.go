@@ -0,0 +1,288 @@
+package gotham
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrCodecMismatch is returned by the Client, when the server
+// announces a codec different from the client's one.
+var ErrCodecMismatch = errors.New("tcp: codec mismatch")
+
+// A SettingID is a connection parameter carried by the SETTINGS frame.
+type SettingID uint16
+
+const (
+	// SettingMaxFrameSize is the size of the largest frame payload
+	// the sender is willing to receive, in bytes.
+	SettingMaxFrameSize SettingID = 0x1
+	// SettingCodec is the id of the codec used by the sender,
+	// see CodecProtobuf and CodecFlatbuffers.
+	SettingCodec SettingID = 0x2
+	// SettingKeepAlive is the interval of the keepalive pings sent
+	// by the client, in milliseconds. The server answers it with the
+	// interval it expects.
+	SettingKeepAlive SettingID = 0x3
+	// SettingMaxMessageSize is the size of the largest message the
+	// sender is willing to receive, in bytes, including all of its
+	// continuation frames.
+	SettingMaxMessageSize SettingID = 0x4
+	// SettingCompressor is the id of the compressor used by the sender,
+	// see CompressorDeflate and CompressorGzip. Zero means no compression.
+	SettingCompressor SettingID = 0x5
+	// SettingChecksum is non-zero, if the sender verifies the checksums
+	// of the frames, see FlagFrameChecksum.
+	SettingChecksum SettingID = 0x6
+)
+
+var settingName = map[SettingID]string{
+	SettingMaxFrameSize:   "MAX_FRAME_SIZE",
+	SettingCodec:          "CODEC",
+	SettingKeepAlive:      "KEEP_ALIVE",
+	SettingMaxMessageSize: "MAX_MESSAGE_SIZE",
+	SettingCompressor:     "COMPRESSOR",
+	SettingChecksum:       "CHECKSUM",
+}
+
+func (s SettingID) String() string {
+	if v, ok := settingName[s]; ok {
+		return v
+	}
+	return fmt.Sprintf("UNKNOWN_SETTING_%d", uint16(s))
+}
+
+// settingLen is the length of a setting in the SETTINGS frame payload,
+// 2 bytes of the id followed by 4 bytes of the value.
+const settingLen = 6
+
+// Setting is a setting parameter: which setting it is, and its value.
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+// The ids of the codecs shipped with the package, which
+// are announced by SettingCodec.
+const (
+	CodecProtobuf    uint32 = 0x1
+	CodecFlatbuffers uint32 = 0x2
+)
+
+// codecID returns the id of the codec, or zero if it is unknown.
+// The codecs announce their ids by implementing the ID method.
+func codecID(codec Codec) uint32 {
+	if ic, ok := codec.(interface{ ID() uint32 }); ok {
+		return ic.ID()
+	}
+	return 0
+}
+
+// connSettings are the parameters of a connection, negotiated by the
+// SETTINGS frames. Zero values mean the peer did not announce them.
+type connSettings struct {
+	maxFrameSize   uint32
+	codec          uint32
+	keepAlive      time.Duration
+	maxMessageSize uint32
+	compressor     uint32
+	checksum       bool
+}
+
+func (cs *connSettings) apply(settings []Setting) {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingMaxFrameSize:
+			cs.maxFrameSize = s.Val
+		case SettingCodec:
+			cs.codec = s.Val
+		case SettingKeepAlive:
+			cs.keepAlive = time.Duration(s.Val) * time.Millisecond
+		case SettingMaxMessageSize:
+			cs.maxMessageSize = s.Val
+		case SettingCompressor:
+			cs.compressor = s.Val
+		case SettingChecksum:
+			cs.checksum = s.Val != 0
+		}
+		// ignore the unknown settings, they may be introduced by newer peers
+	}
+}
+
+func encodeSettings(settings []Setting) []byte {
+	buf := make([]byte, len(settings)*settingLen)
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(buf[i*settingLen:], uint16(s.ID))
+		binary.BigEndian.PutUint32(buf[i*settingLen+2:], s.Val)
+	}
+	return buf
+}
+
+func decodeSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%settingLen != 0 {
+		return nil, ErrFrameSize
+	}
+	settings := make([]Setting, len(payload)/settingLen)
+	for i := range settings {
+		settings[i].ID = SettingID(binary.BigEndian.Uint16(payload[i*settingLen:]))
+		settings[i].Val = binary.BigEndian.Uint32(payload[i*settingLen+2:])
+	}
+	return settings, nil
+}
+
+// processSettings applies the settings of the client, and answers them
+// with the server's own settings.
+func (c *conn) processSettings(fh FrameHeader, payload []byte) error {
+	// the server never sends a SETTINGS frame unsolicited,
+	// so there is nothing to do with the acknowledgement.
+	if fh.Flags.Has(FlagSettingsAck) {
+		return nil
+	}
+
+	settings, err := decodeSettings(payload)
+	if err != nil {
+		return err
+	}
+
+	peer := c.peerSettings()
+	peer.apply(settings)
+	c.settings.Store(peer)
+
+	srv := c.server
+	// never write the frames larger than the client is willing to read
+	fr := srv.framer().negotiate(peer, srv.Compressor)
+	fr.tracer = c.tracer
+	c.framer.Store(fr)
+
+	keepAlive := peer.keepAlive
+	// ask the client to ping often enough, so the conn never idles out
+	if d := srv.idleTimeout(); d != 0 && (keepAlive == 0 || keepAlive >= d) {
+		keepAlive = d / 2
+	}
+
+	return c.writeControlFrame(FrameHeader{Type: FrameSettings, Flags: FlagSettingsAck}, encodeSettings([]Setting{
+		{ID: SettingMaxFrameSize, Val: fr.maxReadFrameSize()},
+		{ID: SettingCodec, Val: codecID(srv.Codec)},
+		{ID: SettingKeepAlive, Val: uint32(keepAlive / time.Millisecond)},
+		{ID: SettingMaxMessageSize, Val: fr.maxReadMessageSize()},
+		{ID: SettingCompressor, Val: compressorID(srv.Compressor)},
+		{ID: SettingChecksum, Val: 1},
+	}))
+}
+
+// peerSettings returns the settings announced by the client.
+func (c *conn) peerSettings() connSettings {
+	if v, ok := c.settings.Load().(connSettings); ok {
+		return v
+	}
+	return connSettings{}
+}
+
+// writeSettings sends the client's settings to the server, the returned
+// channel is closed when the server acknowledges them.
+func (c *Client) writeSettings(ctx context.Context, settings []Setting) (<-chan struct{}, error) {
+	// hold the writer, so the acknowledgements are queued in the order
+	// the settings are written
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	ch := make(chan struct{})
+	c.settingsAck = append(c.settingsAck, ch)
+	c.mu.Unlock()
+
+	return ch, c.writeFrameLocked(ctx, FrameHeader{Type: FrameSettings}, encodeSettings(settings))
+}
+
+// UpdateSettings sends the settings to the server in the middle of the
+// connection, and waits for the server to acknowledge them.
+func (c *Client) UpdateSettings(ctx context.Context, settings ...Setting) error {
+	ch, err := c.writeSettings(ctx, settings)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.getErr()
+	}
+}
+
+// processSettings applies the server's settings, which are always
+// carried by the acknowledgement of the client's settings.
+func (c *Client) processSettings(fh FrameHeader, payload []byte) error {
+	if !fh.Flags.Has(FlagSettingsAck) {
+		// acknowledge the settings, the server may send in the future
+		go c.writeFrame(context.Background(), FrameHeader{Type: FrameSettings, Flags: FlagSettingsAck}, nil)
+		return nil
+	}
+
+	settings, err := decodeSettings(payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.settings.apply(settings)
+	server := c.settings
+	// never write the frames larger than the server is willing to read
+	fr := c.dialer.framer().negotiate(server, c.dialer.Compressor)
+	fr.tracer = c.tracer
+	c.framer.Store(fr)
+	// the acknowledgements are in the order the settings were sent
+	if len(c.settingsAck) > 0 {
+		close(c.settingsAck[0])
+		c.settingsAck = c.settingsAck[1:]
+	}
+	c.mu.Unlock()
+
+	if id := codecID(c.dialer.Codec); id != 0 && server.codec != 0 && id != server.codec {
+		return ErrCodecMismatch
+	}
+
+	if server.keepAlive > 0 {
+		c.startKeepAlive(server.keepAlive)
+	}
+	return nil
+}
+
+// startKeepAlive pings the server at the interval, the connection is
+// closed if the server does not answer in time.
+func (c *Client) startKeepAlive(interval time.Duration) {
+	atomic.StoreInt64(&c.keepAlive, int64(interval))
+	if !atomic.CompareAndSwapInt32(&c.keepAliveStarted, 0, 1) {
+		// the running loop picks up the new interval
+		return
+	}
+
+	go func() {
+		for {
+			interval := time.Duration(atomic.LoadInt64(&c.keepAlive))
+			select {
+			case <-time.After(interval):
+			case <-c.done:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			_, err := c.Ping(ctx)
+			cancel()
+			if err != nil {
+				c.setErr(err)
+				c.rwc.Close()
+				return
+			}
+		}
+	}()
+}
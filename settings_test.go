@@ -0,0 +1,131 @@
+package gotham
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeSettings(t *testing.T) {
+	settings := []Setting{
+		{ID: SettingMaxFrameSize, Val: 1024},
+		{ID: SettingCodec, Val: CodecProtobuf},
+		{ID: SettingID(0xff), Val: 42},
+	}
+	payload := encodeSettings(settings)
+	assert.Equal(t, 3*settingLen, len(payload))
+
+	decoded, err := decodeSettings(payload)
+	assert.NoError(t, err)
+	assert.Equal(t, settings, decoded)
+
+	_, err = decodeSettings(payload[:4])
+	assert.Equal(t, ErrFrameSize, err)
+
+	// the unknown settings are ignored
+	var cs connSettings
+	cs.apply(decoded)
+	assert.Equal(t, connSettings{maxFrameSize: 1024, codec: CodecProtobuf}, cs)
+
+	assert.Equal(t, "MAX_FRAME_SIZE", SettingMaxFrameSize.String())
+	assert.Equal(t, "UNKNOWN_SETTING_255", SettingID(0xff).String())
+}
+
+func TestServerSettings(t *testing.T) {
+	addr := "127.0.0.1:9003"
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	server.IdleTimeout = time.Millisecond * 100
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangePreface(t, conn)
+
+	w := newBufioWriter(conn)
+	r := newBufioReader(conn)
+
+	writeFrame(w, FrameHeader{Type: FrameSettings}, encodeSettings([]Setting{
+		{ID: SettingCodec, Val: CodecProtobuf},
+		{ID: SettingKeepAlive, Val: 500},
+	}))
+	w.Flush()
+
+	// the server acknowledges the settings with its own ones
+	fh, err := ReadFrameHeader(r)
+	assert.NoError(t, err)
+	assert.Equal(t, FrameSettings, fh.Type)
+	assert.True(t, fh.Flags.Has(FlagSettingsAck))
+	payload, _ := readFramePayload(r, fh)
+	settings, err := decodeSettings(payload)
+	assert.NoError(t, err)
+
+	var cs connSettings
+	cs.apply(settings)
+	assert.Equal(t, uint32(DefaultMaxFrameSize), cs.maxFrameSize)
+	assert.Equal(t, CodecProtobuf, cs.codec)
+	// the keepalive is shorter than the idle timeout
+	assert.Equal(t, time.Millisecond*50, cs.keepAlive)
+
+	server.mu.Lock()
+	for c := range server.activeConn {
+		assert.Equal(t, time.Millisecond*500, c.peerSettings().keepAlive)
+	}
+	server.mu.Unlock()
+}
+
+func TestClientSettings(t *testing.T) {
+	addr := "127.0.0.1:9003"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.IdleTimeout = time.Millisecond * 40
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	client, err := Dial("tcp", addr, &ProtobufCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	assert.NoError(t, client.UpdateSettings(context.Background(), Setting{ID: SettingKeepAlive, Val: 10}))
+
+	// the keepalive pings keep the connection open
+	time.Sleep(time.Millisecond * 100)
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, "pb.Ping", res.TypeURL)
+
+	client.mu.Lock()
+	assert.Equal(t, CodecProtobuf, client.settings.codec)
+	assert.Equal(t, time.Millisecond*10, client.settings.keepAlive)
+	client.mu.Unlock()
+}
+
+func TestClientCodecMismatch(t *testing.T) {
+	addr := "127.0.0.1:9003"
+	server := &Server{Addr: addr, Handler: &tHandler{}, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+	client, err := Dial("tcp", addr, &FlatbuffersCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Recv(context.Background())
+	assert.Equal(t, ErrCodecMismatch, err)
+}
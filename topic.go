@@ -0,0 +1,158 @@
+package gotham
+
+import "sync/atomic"
+
+// topics are the subscriptions of the connections, which are guarded by
+// the Server's topicMu. Both the subscribers of each topic and the topics
+// of each connection are kept, so the closed connections are unsubscribed
+// without going through all the topics.
+type topics struct {
+	subscribers map[string]map[*conn]struct{}
+	subscribed  map[*conn]map[string]struct{}
+}
+
+// Subscribe subscribes the connection to the topic, so it receives the
+// messages published to it by the Server's Publish. The connection is
+// unsubscribed from all its topics, when it is closed.
+func (hc *Conn) Subscribe(topic string) {
+	c := hc.c
+	srv := c.server
+	srv.topicMu.Lock()
+	defer srv.topicMu.Unlock()
+
+	// the closed connection is never subscribed again
+	if state, _ := c.getState(); state == StateClosed {
+		return
+	}
+	if srv.topics.subscribers == nil {
+		srv.topics.subscribers = make(map[string]map[*conn]struct{})
+		srv.topics.subscribed = make(map[*conn]map[string]struct{})
+	}
+	subs, ok := srv.topics.subscribers[topic]
+	if !ok {
+		subs = make(map[*conn]struct{})
+		srv.topics.subscribers[topic] = subs
+	}
+	subs[c] = struct{}{}
+	ts, ok := srv.topics.subscribed[c]
+	if !ok {
+		ts = make(map[string]struct{})
+		srv.topics.subscribed[c] = ts
+	}
+	ts[topic] = struct{}{}
+}
+
+// Unsubscribe unsubscribes the connection from the topic.
+func (hc *Conn) Unsubscribe(topic string) {
+	srv := hc.c.server
+	srv.topicMu.Lock()
+	defer srv.topicMu.Unlock()
+	srv.unsubscribeLocked(hc.c, topic)
+}
+
+// Topics returns the topics the connection is subscribed to.
+func (hc *Conn) Topics() []string {
+	srv := hc.c.server
+	srv.topicMu.RLock()
+	defer srv.topicMu.RUnlock()
+	ts := make([]string, 0, len(srv.topics.subscribed[hc.c]))
+	for topic := range srv.topics.subscribed[hc.c] {
+		ts = append(ts, topic)
+	}
+	return ts
+}
+
+// Subscribe subscribes the connection the request was read from to the
+// topic, see Conn.Subscribe.
+func (c *Context) Subscribe(topic string) {
+	if hc := c.Conn(); hc != nil {
+		hc.Subscribe(topic)
+	}
+}
+
+// Unsubscribe unsubscribes the connection the request was read from from
+// the topic, see Conn.Unsubscribe.
+func (c *Context) Unsubscribe(topic string) {
+	if hc := c.Conn(); hc != nil {
+		hc.Unsubscribe(topic)
+	}
+}
+
+// Publish sends the message to all the subscribers of the topic. The message
+// is encoded once by the codec, and queued on each subscriber as Conn.Push
+// does, so it is safe to be called from any goroutine. The subscribers not
+// reading as fast as the messages are published, whose queues are full by
+// MaxPushQueue, miss the message, instead of stalling the others. The
+// messages missed are counted by PublishDrops, and reported by OnPublishDrop.
+// It returns the number of the subscribers the message is queued on.
+func (srv *Server) Publish(topic string, msg interface{}) (int, error) {
+	srv.topicMu.RLock()
+	subs := make([]*conn, 0, len(srv.topics.subscribers[topic]))
+	for c := range srv.topics.subscribers[topic] {
+		subs = append(subs, c)
+	}
+	srv.topicMu.RUnlock()
+
+	if len(subs) == 0 {
+		return 0, nil
+	}
+
+	data, err := srv.Codec.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, c := range subs {
+		if err := c.push(data); err != nil {
+			// the connections closed meanwhile are not dropping anything,
+			// the rest are counted and reported, never logged one by one
+			if err != ErrConnClosed {
+				atomic.AddUint64(&srv.pubDrops, 1)
+				if hook := srv.OnPublishDrop; hook != nil {
+					hook(topic, c.handle, err)
+				}
+			}
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// PublishDrops returns the number of the messages published, which were
+// dropped for the subscribers, see OnPublishDrop.
+func (srv *Server) PublishDrops() uint64 {
+	return atomic.LoadUint64(&srv.pubDrops)
+}
+
+// Subscribers returns the number of the subscribers of the topic.
+func (srv *Server) Subscribers(topic string) int {
+	srv.topicMu.RLock()
+	defer srv.topicMu.RUnlock()
+	return len(srv.topics.subscribers[topic])
+}
+
+// unsubscribeAll unsubscribes the closed connection from all its topics.
+func (srv *Server) unsubscribeAll(c *conn) {
+	srv.topicMu.Lock()
+	defer srv.topicMu.Unlock()
+	for topic := range srv.topics.subscribed[c] {
+		srv.unsubscribeLocked(c, topic)
+	}
+}
+
+func (srv *Server) unsubscribeLocked(c *conn, topic string) {
+	if subs, ok := srv.topics.subscribers[topic]; ok {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(srv.topics.subscribers, topic)
+		}
+	}
+	if ts, ok := srv.topics.subscribed[c]; ok {
+		delete(ts, topic)
+		if len(ts) == 0 {
+			delete(srv.topics.subscribed, c)
+		}
+	}
+}
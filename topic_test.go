@@ -0,0 +1,124 @@
+package gotham
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	addr := "127.0.0.1:9013"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		var msg pb.Ping
+		proto.Unmarshal(c.Request.Data.([]byte), &msg)
+		c.Subscribe(msg.Message)
+		c.Write(&pb.Ping{Message: "subscribed"})
+	})
+
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	subscribe := func(topics ...string) *Client {
+		client, err := (&Dialer{Codec: &ProtobufCodec{}}).Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, topic := range topics {
+			var res Request
+			assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: topic}, &res))
+		}
+		return client
+	}
+	recv := func(client *Client) string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		res, err := client.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg pb.Ping
+		assert.NoError(t, proto.Unmarshal(res.Data.([]byte), &msg))
+		return msg.Message
+	}
+
+	c1 := subscribe("lobby", "room")
+	defer c1.Close()
+	c2 := subscribe("lobby")
+	defer c2.Close()
+	assert.Equal(t, 2, server.Subscribers("lobby"))
+	assert.Equal(t, 1, server.Subscribers("room"))
+
+	n, err := server.Publish("lobby", &pb.Ping{Message: "hello lobby"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "hello lobby", recv(c1))
+	assert.Equal(t, "hello lobby", recv(c2))
+
+	n, _ = server.Publish("room", &pb.Ping{Message: "hello room"})
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "hello room", recv(c1))
+
+	n, err = server.Publish("nobody", &pb.Ping{Message: "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	_, err = server.Publish("lobby", "not a message")
+	assert.Error(t, err)
+
+	conns := server.Conns()
+	assert.Equal(t, 2, len(conns))
+	for _, hc := range conns {
+		topics := hc.Topics()
+		sort.Strings(topics)
+		if len(topics) == 2 {
+			assert.Equal(t, []string{"lobby", "room"}, topics)
+			hc.Unsubscribe("room")
+		}
+	}
+	assert.Equal(t, 0, server.Subscribers("room"))
+
+	// the closed connections are unsubscribed
+	c2.Close()
+	assert.Eventually(t, func() bool {
+		return server.Subscribers("lobby") == 1
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	var drops []string
+	server := &Server{Codec: &ProtobufCodec{}, MaxPushQueue: 1}
+	server.OnPublishDrop = func(topic string, hc *Conn, err error) {
+		assert.Equal(t, ErrPushQueueFull, err)
+		drops = append(drops, topic+" "+hc.c.remoteAddr)
+	}
+	slow := server.newConn(nil)
+	slow.remoteAddr = "slow"
+	fast := server.newConn(nil)
+	fast.remoteAddr = "fast"
+	slow.handle.Subscribe("news")
+	fast.handle.Subscribe("news")
+
+	// the queue of the slow subscriber is full
+	assert.NoError(t, slow.handle.Push(&pb.Ping{Message: "pending"}))
+	n, err := server.Publish("news", &pb.Ping{Message: "news"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, len(fast.pushes))
+
+	// the drops are counted and reported
+	assert.Equal(t, []string{"news slow"}, drops)
+	assert.Equal(t, uint64(1), server.PublishDrops())
+
+	// the closed ones are never subscribed again
+	slow.setState(nil, StateClosed)
+	slow.handle.Subscribe("news")
+	assert.Equal(t, 1, server.Subscribers("news"))
+}
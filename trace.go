@@ -0,0 +1,154 @@
+package gotham
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// TraceFlags selects the frames logged by the frame tracing,
+// see Server.SetTrace and Client.SetTrace.
+type TraceFlags uint32
+
+const (
+	// TraceReads logs the frames read.
+	TraceReads TraceFlags = 1 << iota
+	// TraceWrites logs the frames written.
+	TraceWrites
+
+	// TraceAll logs all the frames.
+	TraceAll = TraceReads | TraceWrites
+)
+
+// traceSet marks the trace flags of a connection, which
+// override the ones of the server.
+const traceSet = 1 << 31
+
+// clientTraceMu guards the TraceWriters of the clients.
+var clientTraceMu sync.Mutex
+
+// traceBodyLen is the length of the payload logged in hex.
+const traceBodyLen = 32
+
+// frameTracer logs the frames of a connection. The control frames are
+// logged one by one, the DATA frames are logged with the whole message,
+// which is decoded by the codec.
+type frameTracer struct {
+	// w is the writer of the lines, which is guarded by mu.
+	w  io.Writer
+	mu *sync.Mutex
+
+	addr  string
+	codec Codec
+	flags func() TraceFlags
+}
+
+func (t *frameTracer) enabled(dir TraceFlags) bool {
+	return t != nil && t.flags()&dir != 0
+}
+
+// trace logs the frame read or written, the payload of the DATA frame
+// is the whole message, before compression.
+func (t *frameTracer) trace(dir TraceFlags, fh FrameHeader, payload []byte) {
+	if !t.enabled(dir) {
+		return
+	}
+
+	op := "read"
+	if dir == TraceWrites {
+		op = "wrote"
+	}
+	line := fmt.Sprintf("[GOTHAM-trace] %s %s %v flags=%#x len=%d", t.addr, op, fh.Type, uint8(fh.Flags), len(payload))
+	if fh.StreamID != 0 {
+		line += fmt.Sprintf(" stream=%d", fh.StreamID)
+	}
+	if fh.Type == FrameData && t.codec != nil {
+		var req Request
+		if err := t.codec.Unmarshal(payload, &req); err == nil {
+			line += " type=" + req.TypeURL
+		}
+	}
+	if len(payload) > traceBodyLen {
+		line += fmt.Sprintf(" body=%s...", hex.EncodeToString(payload[:traceBodyLen]))
+	} else if len(payload) > 0 {
+		line += " body=" + hex.EncodeToString(payload)
+	}
+
+	t.mu.Lock()
+	fmt.Fprintln(t.w, line)
+	t.mu.Unlock()
+}
+
+// SetTrace logs the frames of all the connections into the TraceWriter,
+// unless the connection has its own flags, see SetConnTrace.
+// Zero stops the tracing. It is safe to be called at any time.
+func (srv *Server) SetTrace(flags TraceFlags) {
+	atomic.StoreUint32(&srv.trace, uint32(flags))
+}
+
+// SetConnTrace sets the trace flags of the connection, which override the
+// ones of the server. The connection is the one given to the callbacks,
+// such as ConnState. It reports whether the connection is found.
+func (srv *Server) SetConnTrace(nc net.Conn, flags TraceFlags) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.activeConn {
+		if c.rwc == nc {
+			atomic.StoreUint32(&c.trace, uint32(flags)|traceSet)
+			return true
+		}
+	}
+	return false
+}
+
+// SetTrace sets the trace flags of the connection the request was read from,
+// which override the ones of the server, see Server.SetConnTrace.
+func (req *Request) SetTrace(flags TraceFlags) {
+	if req.conn != nil {
+		atomic.StoreUint32(&req.conn.trace, uint32(flags)|traceSet)
+	}
+}
+
+func (c *conn) traceFlags() TraceFlags {
+	if v := atomic.LoadUint32(&c.trace); v&traceSet != 0 {
+		return TraceFlags(v &^ traceSet)
+	}
+	return TraceFlags(atomic.LoadUint32(&c.server.trace))
+}
+
+func (c *conn) newTracer() *frameTracer {
+	w := c.server.TraceWriter
+	if w == nil {
+		w = DefaultWriter
+	}
+	return &frameTracer{
+		w:     w,
+		mu:    &c.server.traceMu,
+		addr:  c.remoteAddr,
+		codec: c.server.Codec,
+		flags: c.traceFlags,
+	}
+}
+
+// SetTrace logs the frames of the client into the Dialer's TraceWriter.
+// Zero stops the tracing. It is safe to be called at any time.
+func (c *Client) SetTrace(flags TraceFlags) {
+	atomic.StoreUint32(&c.trace, uint32(flags))
+}
+
+func (c *Client) newTracer() *frameTracer {
+	w := c.dialer.TraceWriter
+	if w == nil {
+		w = DefaultWriter
+	}
+	return &frameTracer{
+		w:     w,
+		mu:    &clientTraceMu,
+		addr:  c.rwc.RemoteAddr().String(),
+		codec: c.dialer.Codec,
+		flags: func() TraceFlags { return TraceFlags(atomic.LoadUint32(&c.trace)) },
+	}
+}
@@ -0,0 +1,128 @@
+package gotham
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sleep2death/gotham/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+// traceBuffer is a bytes.Buffer safe for concurrent use.
+type traceBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (tb *traceBuffer) Write(p []byte) (int, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.buf.Write(p)
+}
+
+// reset returns the lines written, and resets the buffer.
+func (tb *traceBuffer) reset() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	s := tb.buf.String()
+	tb.buf.Reset()
+	return s
+}
+
+func TestFrameTracer(t *testing.T) {
+	var buf bytes.Buffer
+	flags := TraceReads
+	tracer := &frameTracer{
+		w:     &buf,
+		mu:    &sync.Mutex{},
+		addr:  "127.0.0.1:9999",
+		codec: &ProtobufCodec{},
+		flags: func() TraceFlags { return flags },
+	}
+
+	payload, _ := (&ProtobufCodec{}).Marshal(&pb.Ping{Message: strings.Repeat("Ping", 10)})
+	tracer.trace(TraceReads, FrameHeader{Type: FrameData, Flags: FlagFrameAck | FlagFrameStream, StreamID: 3}, payload)
+	line := buf.String()
+	assert.True(t, strings.HasPrefix(line, "[GOTHAM-trace] 127.0.0.1:9999 read DATA flags=0x30 len="))
+	assert.Contains(t, line, " stream=3 type=pb.Ping body=")
+	assert.True(t, strings.HasSuffix(line, "...\n"))
+
+	// the writes are not traced
+	buf.Reset()
+	tracer.trace(TraceWrites, FrameHeader{Type: FramePing}, make([]byte, 8))
+	assert.Equal(t, "", buf.String())
+
+	flags = TraceAll
+	tracer.trace(TraceWrites, FrameHeader{Type: FramePing}, make([]byte, 8))
+	assert.Equal(t, "[GOTHAM-trace] 127.0.0.1:9999 wrote PING flags=0x0 len=8 body=0000000000000000\n", buf.String())
+
+	// the nil tracer traces nothing
+	var nilTracer *frameTracer
+	nilTracer.trace(TraceReads, FrameHeader{}, nil)
+}
+
+func TestServerTrace(t *testing.T) {
+	addr := "127.0.0.1:9010"
+	router := New()
+	router.Handle("pb.Ping", func(c *Context) {
+		c.Write(&pb.Ping{Message: "Pong"})
+	})
+
+	var srvTrace, cliTrace traceBuffer
+	conns := make(chan net.Conn, 1)
+	server := &Server{Addr: addr, Handler: router, Codec: &ProtobufCodec{}}
+	server.TraceWriter = &srvTrace
+	server.ConnState = func(nc net.Conn, state ConnState) {
+		if state == StateNew {
+			conns <- nc
+		}
+	}
+	server.SetTrace(TraceAll)
+	go server.ListenAndServe()
+	defer server.Close()
+
+	time.Sleep(time.Millisecond * 5)
+
+	client, err := (&Dialer{Codec: &ProtobufCodec{}, TraceWriter: &cliTrace}).Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTrace(TraceReads)
+	nc := <-conns
+
+	var res Request
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.NoError(t, client.UpdateSettings(context.Background()))
+
+	trace := srvTrace.reset()
+	assert.Contains(t, trace, " read SETTINGS ")
+	assert.Contains(t, trace, " wrote SETTINGS ")
+	assert.Contains(t, trace, " read DATA flags=0x30 len=")
+	assert.Contains(t, trace, " stream=1 type=pb.Ping")
+	assert.Contains(t, trace, " wrote DATA ")
+
+	trace = cliTrace.reset()
+	assert.Contains(t, trace, " read DATA ")
+	assert.NotContains(t, trace, " wrote ")
+
+	// the tracing is stopped at runtime
+	server.SetTrace(0)
+	client.SetTrace(0)
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	assert.Equal(t, "", srvTrace.reset())
+	assert.Equal(t, "", cliTrace.reset())
+
+	// the connection overrides the server
+	assert.True(t, server.SetConnTrace(nc, TraceWrites))
+	assert.False(t, server.SetConnTrace(&net.TCPConn{}, TraceAll))
+	assert.NoError(t, client.Call(context.Background(), &pb.Ping{Message: "Ping"}, &res))
+	trace = srvTrace.reset()
+	assert.Contains(t, trace, " wrote DATA ")
+	assert.NotContains(t, trace, " read ")
+}